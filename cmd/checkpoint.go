@@ -0,0 +1,32 @@
+package cmd
+
+import "time"
+
+// checkpoint is the time up to which a collector has delivered its records.
+type checkpoint struct {
+	Time time.Time `json:"time"`
+}
+
+// loadCheckpoint returns the checkpoint stored under name, or fallback on the
+// first run.
+func loadCheckpoint(cfg Config, name string, fallback time.Time) (time.Time, error) {
+	if cfg.State == nil {
+		return fallback, nil
+	}
+	var stored checkpoint
+	found, err := cfg.State.Load("checkpoint-"+name, &stored)
+	if err != nil || !found {
+		return fallback, err
+	}
+	return stored.Time, nil
+}
+
+// saveCheckpoint stores t under name. It must only be called once the records
+// up to t have been delivered; without a sink nothing was delivered, so the
+// checkpoint is left where it was.
+func saveCheckpoint(cfg Config, name string, t time.Time) error {
+	if cfg.State == nil || t.IsZero() || !cfg.sinksEnabled() {
+		return nil
+	}
+	return cfg.State.Save("checkpoint-"+name, checkpoint{Time: t.UTC()})
+}
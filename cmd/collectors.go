@@ -0,0 +1,59 @@
+package cmd
+
+// Collector describes the records a collector writes to its table.
+type Collector struct {
+	// TimeFields are the record properties holding the event time, in order
+	// of preference. The first one that parses becomes TimeGenerated.
+	TimeFields []string
+	// KeyFields identify a record across runs; their values are hashed into
+	// RecordId. Without them the whole record is hashed.
+	KeyFields []string
+	// Dedupe skips records already delivered by a previous run, for
+	// collectors queried with an overlapping lookback window.
+	Dedupe bool
+	// Snapshot marks point-in-time configuration collectors, whose changes
+	// since the previous run are reported to the MdeSettingsChange table.
+	Snapshot bool
+	// VolatileFields change on every run without being a configuration
+	// change, and are left out of snapshot comparisons.
+	VolatileFields []string
+	// ActorFields hold the user who last changed a record, in order of
+	// preference. Change events of added and changed records carry it as
+	// ChangedBy.
+	ActorFields []string
+	// Columns declares the Log Analytics columns of records DefenderHarvester
+	// builds itself, for provisioning. Other tables are sampled.
+	Columns []SchemaColumn
+}
+
+// defaultTimeFields are tried for tables without a Collector entry, and after
+// the collector specific fields.
+var defaultTimeFields = []string{"EventTime", "eventTime", "Timestamp", "timestamp", "LastUpdateTime", "lastUpdateTime", "CreationTime", "creationTime"}
+
+var collectors = map[string]Collector{
+	"MdeMachineActions":          {TimeFields: []string{"EventTime", "ActionTime", "eventTime"}, KeyFields: []string{"ActionId", "ActionStatus", "LastUpdateTime"}, Dedupe: true},
+	"MdeMachineActionsApi":       {TimeFields: []string{"lastUpdateDateTimeUtc", "creationDateTimeUtc"}, KeyFields: []string{"id", "lastUpdateDateTimeUtc"}, Dedupe: true},
+	"MdeLiveResponseCommands":    {TimeFields: []string{"EndTime", "StartTime"}, KeyFields: []string{"ParentActionId", "CommandIndex", "CommandStatus"}, Dedupe: true, Columns: liveResponseColumns},
+	"MdeLiveResponseLibrary":     {TimeFields: []string{"lastUpdatedTime", "creationTime"}, KeyFields: []string{"fileName"}, Snapshot: true},
+	"MdeIndicators":              {TimeFields: []string{"lastUpdateTime", "creationTimeDateTimeUtc"}, KeyFields: []string{"id"}, Snapshot: true, ActorFields: []string{"lastUpdatedBy", "createdBy"}},
+	"MdeCustomDetectionState":    {TimeFields: []string{"LastUpdateTime", "LastRunTime", "CreationTime"}, KeyFields: []string{"Id"}, Snapshot: true, VolatileFields: []string{"LastRunTime", "NextRunTime", "LastRunStatus"}},
+	"MdeAdvancedFeatureSettings": {Snapshot: true},
+	"MdeSuppressionRules":        {TimeFields: []string{"UpdateTime", "CreationTime"}, KeyFields: []string{"Id"}, Snapshot: true},
+	"MdeMachineGroups":           {TimeFields: []string{"LastUpdated"}, KeyFields: []string{"MachineGroupId"}, Snapshot: true},
+	"MdeRoles":                   {TimeFields: []string{"LastUpdated"}, KeyFields: []string{"Id"}, Snapshot: true},
+	"MdeRoleMachineGroups":       {KeyFields: []string{"RoleId", "MachineGroupId"}, Snapshot: true, Columns: roleMachineGroupColumns},
+	"MdeConnectedAppStats":       {TimeFields: []string{"LatestUsage", "LastSeen"}, KeyFields: []string{"AppId"}},
+	"MdeExecutedQueries":         {TimeFields: []string{"StartTime", "ExecutionTime", "Timestamp"}, KeyFields: []string{"ReportId", "StartTime"}, Dedupe: true},
+	"MdeDevices":                 {TimeFields: []string{"lastSeen", "firstSeen"}, KeyFields: []string{"id"}},
+	"MdeTimeline":                {TimeFields: []string{"ActionTime", "Timestamp", "EventTime"}, KeyFields: []string{"EventId", "ActionTime"}, Dedupe: true},
+	"M365Incidents":              {TimeFields: []string{"lastUpdateDateTime", "createdDateTime"}, KeyFields: []string{"id", "lastUpdateDateTime"}, Dedupe: true},
+	"M365Alerts":                 {TimeFields: []string{"lastUpdateDateTime", "createdDateTime"}, KeyFields: []string{"id", "lastUpdateDateTime"}, Dedupe: true},
+	"M365AlertServiceSettings":   {TimeFields: []string{"LastModifiedTime"}, KeyFields: []string{"WorkloadName"}, Snapshot: true},
+	"MdeSettingsChange":          {TimeFields: []string{"ChangeTime"}, KeyFields: []string{"SourceTable", "RecordKey", "Field", "ChangeTime"}, Columns: settingsChangeColumns},
+	"MdeConfigFindings":          {TimeFields: []string{"ChangeTime"}, KeyFields: []string{"RuleId", "RecordKey", "Field", "ChangeTime"}, Columns: findingColumns},
+	"M365DataExportSettings":     {KeyFields: []string{"id"}, Snapshot: true},
+}
+
+func collectorFor(table string) Collector {
+	return collectors[table]
+}
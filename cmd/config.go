@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Config carries the run-wide settings shared by every collector.
+type Config struct {
+	AccessToken      string
+	GraphToken       string
+	TenantID         string
+	Region           string
+	HarvesterVersion string
+	HarvestTime      time.Time
+	State            *StateStore
+	Dedupe           bool
+	Rules            []Rule
+	Sentinel         bool
+	Splunk           bool
+	Files            bool
+	FileOptions      FileOptions
+	Elastic          bool
+	Kafka            bool
+	EventHubs        bool
+	ObjectStore      bool
+	Syslog           bool
+	Webhooks         []Webhook
+	OTLP             bool
+	SQLite           string
+	Debug            bool
+}
+
+// sinksEnabled reports whether records are sent anywhere.
+func (c Config) sinksEnabled() bool {
+	return c.Files || c.Sentinel || c.Splunk || c.Elastic || c.Kafka || c.EventHubs || c.ObjectStore || c.Syslog || len(c.Webhooks) > 0 || c.OTLP || c.SQLite != ""
+}
+
+// TenantFromToken returns the tenant id (tid claim) of a JWT access token, or
+// an empty string when the token can not be decoded.
+func TenantFromToken(accessToken string) string {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		TenantID string `json:"tid"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.TenantID
+}
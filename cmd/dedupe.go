@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// maxSeenRecords bounds the seen-set kept per table; the oldest ids are
+// dropped first.
+const maxSeenRecords = 100000
+
+// recordKey returns the stable key of a record: the collector's key fields
+// when present, otherwise the canonical JSON of the whole record without its
+// RecordId.
+func recordKey(table string, record Record) string {
+	if parts := keyParts(table, record); len(parts) > 0 {
+		return table + "|" + strings.Join(parts, "|")
+	}
+
+	// encoding/json sorts map keys, which makes this deterministic. A
+	// RecordId assigned before is left out so the id does not change.
+	data, _ := json.Marshal(withoutFields(record, []string{"RecordId"}))
+	return table + "|" + string(data)
+}
+
+// keyParts returns the collector's key fields present in record as
+// field=value pairs.
+func keyParts(table string, record Record) []string {
+	var parts []string
+	for _, field := range collectorFor(table).KeyFields {
+		if value, ok := record[field]; ok && value != nil {
+			parts = append(parts, fmt.Sprintf("%s=%v", field, value))
+		}
+	}
+	return parts
+}
+
+// AssignRecordIDs hashes the stable key of each record into its RecordId field.
+func AssignRecordIDs(table string, records []Record) {
+	for _, record := range records {
+		sum := sha256.Sum256([]byte(recordKey(table, record)))
+		record["RecordId"] = hex.EncodeToString(sum[:])
+	}
+}
+
+// seenSet holds the record ids already delivered for a table, oldest first.
+type seenSet struct {
+	IDs   []string `json:"ids"`
+	index map[string]struct{}
+}
+
+func loadSeenSet(state *StateStore, table string) (*seenSet, error) {
+	seen := &seenSet{}
+	if _, err := state.Load("seen-"+table, seen); err != nil {
+		return nil, err
+	}
+	seen.index = make(map[string]struct{}, len(seen.IDs))
+	for _, id := range seen.IDs {
+		seen.index[id] = struct{}{}
+	}
+	return seen, nil
+}
+
+// filter drops the records whose RecordId has been delivered before.
+func (s *seenSet) filter(records []Record) []Record {
+	var fresh []Record
+	for _, record := range records {
+		id, _ := record["RecordId"].(string)
+		if _, ok := s.index[id]; ok {
+			continue
+		}
+		fresh = append(fresh, record)
+	}
+	return fresh
+}
+
+func (s *seenSet) add(records []Record) {
+	for _, record := range records {
+		id, _ := record["RecordId"].(string)
+		if _, ok := s.index[id]; ok {
+			continue
+		}
+		s.index[id] = struct{}{}
+		s.IDs = append(s.IDs, id)
+	}
+	if len(s.IDs) > maxSeenRecords {
+		for _, id := range s.IDs[:len(s.IDs)-maxSeenRecords] {
+			delete(s.index, id)
+		}
+		s.IDs = append([]string(nil), s.IDs[len(s.IDs)-maxSeenRecords:]...)
+	}
+}
+
+func (s *seenSet) save(state *StateStore, table string) error {
+	return state.Save("seen-"+table, s)
+}
+
+// skipDelivered removes records delivered by a previous run. The returned
+// seen-set must be committed once the fresh records have been delivered.
+func skipDelivered(cfg Config, table string, records []Record) ([]Record, *seenSet, error) {
+	if !cfg.Dedupe || cfg.State == nil || !collectorFor(table).Dedupe {
+		return records, nil, nil
+	}
+
+	seen, err := loadSeenSet(cfg.State, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	fresh := seen.filter(records)
+	if skipped := len(records) - len(fresh); skipped > 0 {
+		log.Printf("Skipping %d %s records delivered by a previous run\n", skipped, table)
+	}
+	return fresh, seen, nil
+}
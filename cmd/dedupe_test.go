@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func recordID(t *testing.T, table string, record Record) string {
+	t.Helper()
+	AssignRecordIDs(table, []Record{record})
+	id, _ := record["RecordId"].(string)
+	if len(id) != 64 {
+		t.Fatalf("RecordId %q is not a sha256 hex digest", id)
+	}
+	return id
+}
+
+func TestRecordIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+		a     Record
+		b     Record
+		same  bool
+	}{
+		{
+			name:  "key fields identify the record",
+			table: "MdeTimeline",
+			a:     Record{"EventId": "1", "ActionTime": "2024-03-05T10:00:00Z", "FileName": "a.exe"},
+			b:     Record{"EventId": "1", "ActionTime": "2024-03-05T10:00:00Z", "FileName": "b.exe", "Extra": true},
+			same:  true,
+		},
+		{
+			name:  "different key values",
+			table: "MdeTimeline",
+			a:     Record{"EventId": "1", "ActionTime": "2024-03-05T10:00:00Z"},
+			b:     Record{"EventId": "1", "ActionTime": "2024-03-05T10:00:01Z"},
+		},
+		{
+			name:  "action status is part of the key",
+			table: "MdeMachineActions",
+			a:     Record{"ActionId": "a1", "ActionStatus": "Pending"},
+			b:     Record{"ActionId": "a1", "ActionStatus": "Succeeded"},
+		},
+		{
+			name:  "same key in another table",
+			table: "MdeRoles",
+			a:     Record{"Id": 1},
+			b:     Record{"Id": 1},
+			same:  true,
+		},
+		{
+			name:  "without key fields the whole record is hashed",
+			table: "MdeAdvancedFeatureSettings",
+			a:     Record{"a": 1, "b": "x"},
+			b:     Record{"b": "x", "a": 1},
+			same:  true,
+		},
+		{
+			name:  "without key fields any change is a new record",
+			table: "MdeAdvancedFeatureSettings",
+			a:     Record{"a": 1, "b": "x"},
+			b:     Record{"a": 2, "b": "x"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := recordID(t, test.table, test.a), recordID(t, test.table, test.b)
+			if (a == b) != test.same {
+				t.Errorf("ids %s and %s, want equal %v", a, b, test.same)
+			}
+			if again := recordID(t, test.table, test.a); again != a {
+				t.Errorf("id changed from %s to %s when assigned again", a, again)
+			}
+		})
+	}
+
+	roles := recordID(t, "MdeRoles", Record{"Id": 1})
+	groups := recordID(t, "MdeMachineGroups", Record{"Id": 1})
+	if roles == groups {
+		t.Error("records of different tables with the same fields share an id")
+	}
+}
+
+func timelineRecords(ids ...int) []Record {
+	records := make([]Record, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, Record{"EventId": id, "ActionTime": "2024-03-05T10:00:00Z"})
+	}
+	AssignRecordIDs("MdeTimeline", records)
+	return records
+}
+
+func TestSkipDeliveredAcrossRuns(t *testing.T) {
+	state, err := NewStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{State: state, Dedupe: true}
+
+	fresh, seen, err := skipDelivered(cfg, "MdeTimeline", timelineRecords(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != 2 {
+		t.Fatalf("first run kept %d records, want 2", len(fresh))
+	}
+	seen.add(fresh)
+	if err := seen.save(state, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, _, err = skipDelivered(cfg, "MdeTimeline", timelineRecords(1, 2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fresh) != 1 || fresh[0]["EventId"] != 3 {
+		t.Errorf("second run kept %v, want only EventId 3", fresh)
+	}
+}
+
+func TestSkipDeliveredDisabled(t *testing.T) {
+	state, err := NewStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := &seenSet{index: map[string]struct{}{}}
+	seen.add(timelineRecords(1))
+	if err := seen.save(state, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		table string
+	}{
+		{"-nodedupe", Config{State: state, Dedupe: false}, "MdeTimeline"},
+		{"no state directory", Config{Dedupe: true}, "MdeTimeline"},
+		{"collector without dedupe", Config{State: state, Dedupe: true}, "MdeDevices"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fresh, seen, err := skipDelivered(test.cfg, test.table, timelineRecords(1, 2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fresh) != 2 || seen != nil {
+				t.Errorf("kept %d records with seen-set %v, want all 2 records and no seen-set", len(fresh), seen)
+			}
+		})
+	}
+}
+
+func TestSeenSetKeepsMostRecentIDs(t *testing.T) {
+	seen := &seenSet{index: map[string]struct{}{}}
+	var records []Record
+	for i := 0; i < maxSeenRecords+5; i++ {
+		records = append(records, Record{"RecordId": fmt.Sprintf("id-%d", i)})
+	}
+	seen.add(records[:10])
+	seen.add(records)
+
+	if len(seen.IDs) != maxSeenRecords || len(seen.index) != maxSeenRecords {
+		t.Fatalf("kept %d ids and %d indexed, want %d", len(seen.IDs), len(seen.index), maxSeenRecords)
+	}
+	if seen.IDs[0] != "id-5" || seen.IDs[len(seen.IDs)-1] != fmt.Sprintf("id-%d", maxSeenRecords+4) {
+		t.Errorf("kept ids %s to %s, want id-5 to the last one", seen.IDs[0], seen.IDs[len(seen.IDs)-1])
+	}
+	if fresh := seen.filter(records[:6]); len(fresh) != 5 || fresh[0]["RecordId"] != "id-0" {
+		t.Errorf("the oldest ids were not dropped: %v", fresh)
+	}
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// sentinelBatchSize keeps each Log Analytics post well below the payload limit.
+const sentinelBatchSize = 1000
+
+// deliver sends the records collected from endpoint to every enabled sink.
+// For configuration collectors it also sends the changes since the previous
+// snapshot and the rule findings over those changes.
+func deliver(cfg Config, table string, endpoint string, records []Record) error {
+	changes, commit, err := detectDrift(cfg, table, records)
+	if err != nil {
+		return err
+	}
+
+	if err := send(cfg, table, endpoint, records); err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		if err := send(cfg, SettingsChangeTable, endpoint, changes); err != nil {
+			return err
+		}
+	}
+	if findings := EvaluateRules(cfg.Rules, changes); len(findings) > 0 {
+		if err := send(cfg, FindingsTable, endpoint, findings); err != nil {
+			return err
+		}
+	}
+
+	// Without a sink nothing was delivered, so the snapshot must not advance.
+	if !cfg.sinksEnabled() {
+		return nil
+	}
+	return commit()
+}
+
+// send enriches records and writes them to every sink enabled in cfg.
+func send(cfg Config, table string, endpoint string, records []Record) error {
+	if !cfg.sinksEnabled() {
+		return nil
+	}
+	if len(records) == 0 {
+		log.Printf("No %s records to send\n", table)
+		return nil
+	}
+
+	AssignRecordIDs(table, records)
+	records, seen, err := skipDelivered(cfg, table, records)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	Enrich(cfg, table, endpoint, records)
+
+	if cfg.Files {
+		if err := WriteToFiles(records, table, cfg.FileOptions); err != nil {
+			return fmt.Errorf("failed to write records to file: %w", err)
+		}
+	}
+
+	if cfg.Splunk {
+		body, err := json.Marshal(records)
+		if err != nil {
+			return fmt.Errorf("failed to marshal records: %w", err)
+		}
+		log.Printf("Sending %d events to Splunk\n", len(records))
+		if err := PostToSplunk(body, table); err != nil {
+			return fmt.Errorf("failed to write records to Splunk: %w", err)
+		}
+	}
+
+	if cfg.Sentinel && table != "" && LogsIngestionEnabled() {
+		log.Printf("Sending %d events to Sentinel through the Logs Ingestion API\n", len(records))
+		if err := SendToLogsIngestion(records, table); err != nil {
+			return fmt.Errorf("failed to write records to Sentinel: %w", err)
+		}
+	} else if cfg.Sentinel && table != "" {
+		numBatches := (len(records) + sentinelBatchSize - 1) / sentinelBatchSize
+		log.Printf("Sending %d events to Sentinel in %d batches\n", len(records), numBatches)
+		for i := 0; i < numBatches; i++ {
+			start := i * sentinelBatchSize
+			end := start + sentinelBatchSize
+			if end > len(records) {
+				end = len(records)
+			}
+			body, err := json.Marshal(records[start:end])
+			if err != nil {
+				return fmt.Errorf("failed to marshal batch %d: %w", i, err)
+			}
+			if err := SendToSentinel(body, table); err != nil {
+				return fmt.Errorf("failed to write records to Sentinel: %w", err)
+			}
+		}
+	}
+
+	if cfg.Elastic {
+		log.Printf("Sending %d events to Elasticsearch\n", len(records))
+		if err := SendToElastic(records, table); err != nil {
+			return fmt.Errorf("failed to write records to Elasticsearch: %w", err)
+		}
+	}
+
+	if cfg.Kafka {
+		log.Printf("Sending %d events to Kafka\n", len(records))
+		if err := SendToKafka(records, table); err != nil {
+			return fmt.Errorf("failed to write records to Kafka: %w", err)
+		}
+	}
+
+	if cfg.EventHubs {
+		log.Printf("Sending %d events to Event Hubs\n", len(records))
+		if err := SendToEventHubs(records, table); err != nil {
+			return fmt.Errorf("failed to write records to Event Hubs: %w", err)
+		}
+	}
+
+	if cfg.ObjectStore {
+		log.Printf("Archiving %d events to object storage\n", len(records))
+		if err := SendToObjectStore(records, table); err != nil {
+			return fmt.Errorf("failed to write records to object storage: %w", err)
+		}
+	}
+
+	if cfg.Syslog {
+		log.Printf("Sending %d events to syslog\n", len(records))
+		if err := SendToSyslog(records, table); err != nil {
+			return fmt.Errorf("failed to write records to syslog: %w", err)
+		}
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		if err := SendToWebhooks(cfg.Webhooks, records, table); err != nil {
+			return fmt.Errorf("failed to post records to webhooks: %w", err)
+		}
+	}
+
+	if cfg.OTLP {
+		log.Printf("Sending %d events to OTLP\n", len(records))
+		if err := SendToOTLP(records, table); err != nil {
+			return fmt.Errorf("failed to write records to OTLP: %w", err)
+		}
+	}
+
+	if cfg.SQLite != "" {
+		if err := SaveToSQLite(records, table, cfg.SQLite); err != nil {
+			return fmt.Errorf("failed to store records in SQLite: %w", err)
+		}
+	}
+
+	if seen != nil {
+		seen.add(records)
+		if err := seen.save(cfg.State, table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
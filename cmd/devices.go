@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DevicesTable holds the device inventory.
+const DevicesTable = "MdeDevices"
+
+var (
+	// machineIDPattern matches a MachineId, the 40 character hex device id.
+	machineIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+	// aadDeviceIDPattern matches the Azure AD device id GUID.
+	aadDeviceIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	// hexPattern matches strings that look like a mistyped device id.
+	hexPattern = regexp.MustCompile(`^[0-9a-fA-F-]{32,}$`)
+)
+
+// IsMachineID reports whether id is formatted as a MachineId.
+func IsMachineID(id string) bool {
+	return machineIDPattern.MatchString(id)
+}
+
+// AmbiguousMachineError is returned when a name matches several devices.
+type AmbiguousMachineError struct {
+	Name       string
+	Candidates []Record
+}
+
+func (e *AmbiguousMachineError) Error() string {
+	lines := []string{fmt.Sprintf("%s matches %d devices, use the MachineId or -latest to pick the most recently seen:", e.Name, len(e.Candidates))}
+	for _, machine := range e.Candidates {
+		lines = append(lines, fmt.Sprintf("  %s  %s  last seen %s  %s",
+			fieldString(machine, "id"),
+			fieldString(machine, "computerDnsName"),
+			fieldString(machine, "lastSeen"),
+			fieldString(machine, "lastIpAddress")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ResolveMachineID returns the MachineId of a device, looked up in the device
+// inventory on the public API at location. name is a MachineId, an Azure AD
+// device id, an IP address, a DNS name or a NetBIOS name. When several
+// devices match, the most recently seen one is returned if latest is set, and
+// an AmbiguousMachineError listing them otherwise.
+func ResolveMachineID(cfg Config, location string, name string, latest bool) (string, error) {
+	name = strings.TrimSpace(name)
+	quoted := strings.ReplaceAll(strings.ToLower(name), "'", "''")
+
+	var filter string
+	switch {
+	case name == "":
+		return "", fmt.Errorf("no MachineId or hostname set")
+	case IsMachineID(name):
+		id := strings.ToLower(name)
+		// Looking the id up needs Machine.Read, which the timeline itself
+		// does not, so without it the id is used as given.
+		_, err := fetchMDE(cfg, fmt.Sprintf("https://%s.securitycenter.windows.com/api/machines/%s", location, id))
+		var status *statusError
+		switch {
+		case errors.As(err, &status) && status.StatusCode == http.StatusForbidden:
+			log.Printf("Not allowed to look up MachineId %s, using it as given\n", id)
+		case err != nil:
+			return "", fmt.Errorf("MachineId %s not found: %w", id, err)
+		}
+		return id, nil
+	case aadDeviceIDPattern.MatchString(name):
+		filter = fmt.Sprintf("aadDeviceId eq '%s'", quoted)
+	case hexPattern.MatchString(name):
+		return "", fmt.Errorf("%s is not a valid MachineId, it should be 40 hexadecimal characters", name)
+	case net.ParseIP(name) != nil:
+		filter = fmt.Sprintf("lastIpAddress eq '%s'", quoted)
+	case strings.Contains(name, "."):
+		filter = fmt.Sprintf("computerDnsName eq '%s'", quoted)
+	default:
+		// A NetBIOS name is the first label of the DNS name.
+		filter = fmt.Sprintf("computerDnsName eq '%s' or startswith(computerDnsName,'%s.')", quoted, quoted)
+	}
+
+	machines, err := findMachines(cfg, location, filter)
+	if err != nil {
+		return "", err
+	}
+
+	var machine Record
+	switch {
+	case len(machines) == 0:
+		return "", fmt.Errorf("no device named %s found", name)
+	case len(machines) == 1:
+		machine = machines[0]
+	case latest:
+		sort.SliceStable(machines, func(i, j int) bool {
+			ti, _ := parseTime(fieldString(machines[i], "lastSeen"))
+			tj, _ := parseTime(fieldString(machines[j], "lastSeen"))
+			return ti.After(tj)
+		})
+		machine = machines[0]
+	default:
+		return "", &AmbiguousMachineError{Name: name, Candidates: machines}
+	}
+
+	id := fieldString(machine, "id")
+	log.Printf("Resolved %s to MachineId %s (%s)\n", name, id, fieldString(machine, "computerDnsName"))
+	return id, nil
+}
+
+// findMachines returns the devices matching an OData filter.
+func findMachines(cfg Config, location string, filter string) ([]Record, error) {
+	next := fmt.Sprintf("https://%s.securitycenter.windows.com/api/machines?$filter=%s", location, strings.ReplaceAll(url.QueryEscape(filter), "+", "%20"))
+
+	var machines []Record
+	for next != "" {
+		body, err := fetchMDE(cfg, next)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the device inventory: %w", err)
+		}
+		page, err := DecodeRecords(body)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, page...)
+		next = nextLink(body)
+	}
+	return machines, nil
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// redirectTransport sends every request to a test server, so code calling
+// the MDE API by its fixed host names can be tested.
+type redirectTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return t.next.RoundTrip(req)
+}
+
+// newMDEServer starts handler as the MDE API and returns the requests it
+// received.
+func newMDEServer(t *testing.T, handler http.HandlerFunc) *[]*http.Request {
+	t.Helper()
+	var requests []*http.Request
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r)
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	target, _ := url.Parse(s.URL)
+	original := http.DefaultTransport
+	http.DefaultTransport = redirectTransport{target: target, next: original}
+	t.Cleanup(func() { http.DefaultTransport = original })
+	return &requests
+}
+
+const (
+	machineA = "0123456789abcdef0123456789abcdef01234567"
+	machineB = "89abcdef0123456789abcdef0123456789abcdef"
+)
+
+var inventory = []map[string]string{
+	{"id": machineA, "computerDnsName": "ws01.contoso.com", "lastSeen": "2024-03-01T10:00:00Z", "lastIpAddress": "10.0.0.5", "aadDeviceId": "11111111-2222-3333-4444-555555555555"},
+	{"id": machineB, "computerDnsName": "ws01.fabrikam.com", "lastSeen": "2024-03-05T10:00:00Z", "lastIpAddress": "10.0.0.5"},
+}
+
+// inventoryHandler answers device inventory queries for the filters
+// ResolveMachineID sends.
+func inventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/machines" {
+		http.NotFound(w, r)
+		return
+	}
+	filter := r.URL.Query().Get("$filter")
+	var matches []string
+	for _, machine := range inventory {
+		var match bool
+		switch {
+		case strings.HasPrefix(filter, "aadDeviceId eq "):
+			match = filter == fmt.Sprintf("aadDeviceId eq '%s'", machine["aadDeviceId"])
+		case strings.HasPrefix(filter, "lastIpAddress eq "):
+			match = filter == fmt.Sprintf("lastIpAddress eq '%s'", machine["lastIpAddress"])
+		case strings.Contains(filter, "startswith"):
+			netbios := strings.SplitN(machine["computerDnsName"], ".", 2)[0]
+			match = filter == fmt.Sprintf("computerDnsName eq '%s' or startswith(computerDnsName,'%s.')", netbios, netbios)
+		default:
+			match = filter == fmt.Sprintf("computerDnsName eq '%s'", machine["computerDnsName"])
+		}
+		if match {
+			matches = append(matches, fmt.Sprintf(`{"id":%q,"computerDnsName":%q,"lastSeen":%q,"lastIpAddress":%q}`,
+				machine["id"], machine["computerDnsName"], machine["lastSeen"], machine["lastIpAddress"]))
+		}
+	}
+	fmt.Fprintf(w, `{"value":[%s]}`, strings.Join(matches, ","))
+}
+
+func TestResolveMachineID(t *testing.T) {
+	requests := newMDEServer(t, inventoryHandler)
+
+	tests := []struct {
+		name   string
+		latest bool
+		want   string
+		filter string
+	}{
+		{name: "WS01.contoso.com", want: machineA, filter: "computerDnsName eq 'ws01.contoso.com'"},
+		{name: "ws01.fabrikam.com", want: machineB},
+		{name: "11111111-2222-3333-4444-555555555555", want: machineA, filter: "aadDeviceId eq '11111111-2222-3333-4444-555555555555'"},
+		{name: "10.0.0.5", latest: true, want: machineB, filter: "lastIpAddress eq '10.0.0.5'"},
+		{name: "WS01", latest: true, want: machineB, filter: "computerDnsName eq 'ws01' or startswith(computerDnsName,'ws01.')"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*requests = nil
+			got, err := ResolveMachineID(Config{AccessToken: "token"}, "api", test.name, test.latest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("resolved to %s, want %s", got, test.want)
+			}
+			if len(*requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(*requests))
+			}
+			req := (*requests)[0]
+			if req.Host != "api.securitycenter.windows.com" || req.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("request to %s with authorization %q", req.Host, req.Header.Get("Authorization"))
+			}
+			if test.filter != "" && req.URL.Query().Get("$filter") != test.filter {
+				t.Errorf("filter %q, want %q", req.URL.Query().Get("$filter"), test.filter)
+			}
+		})
+	}
+}
+
+func TestResolveMachineIDAmbiguous(t *testing.T) {
+	newMDEServer(t, inventoryHandler)
+
+	for _, name := range []string{"10.0.0.5", "ws01"} {
+		_, err := ResolveMachineID(Config{}, "api", name, false)
+		var ambiguous *AmbiguousMachineError
+		if !errors.As(err, &ambiguous) {
+			t.Fatalf("%s returned %v, want an AmbiguousMachineError", name, err)
+		}
+		if len(ambiguous.Candidates) != 2 || !strings.Contains(err.Error(), machineA) || !strings.Contains(err.Error(), machineB) {
+			t.Errorf("%s error does not list both devices: %v", name, err)
+		}
+	}
+
+	if _, err := ResolveMachineID(Config{}, "api", "ws99.contoso.com", false); err == nil || !strings.Contains(err.Error(), "no device named") {
+		t.Errorf("unknown device returned %v", err)
+	}
+	if _, err := ResolveMachineID(Config{}, "api", machineA[:39], false); err == nil || !strings.Contains(err.Error(), "not a valid MachineId") {
+		t.Errorf("mistyped MachineId returned %v", err)
+	}
+}
+
+func TestResolveMachineIDBareID(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"found", http.StatusOK, false},
+		{"not found", http.StatusNotFound, true},
+		{"no Machine.Read permission", http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := newMDEServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				fmt.Fprintf(w, `{"id":%q}`, machineA)
+			})
+
+			got, err := ResolveMachineID(Config{}, "api", strings.ToUpper(machineA), false)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && got != machineA {
+				t.Errorf("resolved to %s, want the lowercased id %s", got, machineA)
+			}
+			if len(*requests) != 1 || (*requests)[0].URL.Path != "/api/machines/"+machineA {
+				t.Errorf("requests %v, want one lookup of the id", *requests)
+			}
+		})
+	}
+}
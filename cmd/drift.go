@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SettingsChangeTable receives the differences between configuration snapshots.
+const SettingsChangeTable = "MdeSettingsChange"
+
+// settingsChangeColumns declares the change records for provisioning.
+var settingsChangeColumns = []SchemaColumn{
+	{Name: "SourceTable", Type: "string"},
+	{Name: "ChangeType", Type: "string"},
+	{Name: "RecordKey", Type: "string"},
+	{Name: "Field", Type: "string"},
+	{Name: "OldValue", Type: "dynamic"},
+	{Name: "NewValue", Type: "dynamic"},
+	{Name: "ChangedBy", Type: "string"},
+	{Name: "PreviousSnapshotTime", Type: "datetime"},
+	{Name: "ChangeTime", Type: "datetime"},
+}
+
+// snapshot is the previous state of a configuration collector.
+type snapshot struct {
+	Time    time.Time `json:"time"`
+	Records []Record  `json:"records"`
+}
+
+// detectDrift compares records with the snapshot stored by the previous run
+// and returns one change record per added, removed or changed field. The
+// returned commit function stores records as the new snapshot and must only
+// be called once the changes have been delivered.
+func detectDrift(cfg Config, table string, records []Record) ([]Record, func() error, error) {
+	noop := func() error { return nil }
+	if cfg.State == nil || !collectorFor(table).Snapshot {
+		return nil, noop, nil
+	}
+
+	// Normalize through JSON so the current records compare equal to the
+	// decoded previous snapshot.
+	current, err := normalizeRecords(records)
+	if err != nil {
+		return nil, noop, err
+	}
+
+	name := "snapshot-" + table
+	commit := func() error {
+		return cfg.State.Save(name, snapshot{Time: cfg.HarvestTime, Records: current})
+	}
+
+	var previous snapshot
+	found, err := cfg.State.Load(name, &previous)
+	if err != nil {
+		return nil, noop, err
+	}
+	if !found {
+		log.Printf("Stored the first %s snapshot, changes are reported from the next run\n", table)
+		return nil, commit, nil
+	}
+
+	changes := diffSnapshots(table, previous.Records, current)
+	for _, change := range changes {
+		change["PreviousSnapshotTime"] = previous.Time.UTC().Format(time.RFC3339Nano)
+		change["ChangeTime"] = cfg.HarvestTime.UTC().Format(time.RFC3339Nano)
+	}
+	if len(changes) > 0 {
+		log.Printf("Detected %d changes in %s since %s\n", len(changes), table, previous.Time.Format(time.RFC3339))
+	}
+	return changes, commit, nil
+}
+
+func normalizeRecords(records []Record) ([]Record, error) {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	var normalized []Record
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	return normalized, nil
+}
+
+// snapshotKeys labels each record of a snapshot. Records are matched on the
+// collector's key fields, or on their position when the collector has none.
+// Of records sharing a key only the last one is kept.
+func snapshotKeys(table string, records []Record) ([]string, map[string]Record) {
+	keys := make([]string, 0, len(records))
+	byKey := make(map[string]Record, len(records))
+	var duplicates int
+	for i, record := range records {
+		key := strings.Join(keyParts(table, record), ",")
+		if key == "" {
+			key = fmt.Sprintf("#%d", i)
+		}
+		if _, ok := byKey[key]; ok {
+			duplicates++
+		} else {
+			keys = append(keys, key)
+		}
+		byKey[key] = record
+	}
+	if duplicates > 0 {
+		log.Printf("%d %s records share their key with another record, only the last one is compared\n", duplicates, table)
+	}
+	return keys, byKey
+}
+
+// diffSnapshots returns the changes between two snapshots of table.
+func diffSnapshots(table string, previous []Record, current []Record) []Record {
+	previousKeys, previousByKey := snapshotKeys(table, previous)
+	currentKeys, currentByKey := snapshotKeys(table, current)
+
+	volatile := collectorFor(table).VolatileFields
+
+	var changes []Record
+	newChange := func(changeType string, key string, field string, oldValue interface{}, newValue interface{}, actor string) {
+		change := Record{
+			"SourceTable": table,
+			"ChangeType":  changeType,
+			"RecordKey":   key,
+			"Field":       field,
+			"OldValue":    oldValue,
+			"NewValue":    newValue,
+		}
+		if actor != "" {
+			change["ChangedBy"] = actor
+		}
+		changes = append(changes, change)
+	}
+
+	// The user who removed a record is not known, it is no longer returned.
+	for _, key := range previousKeys {
+		if _, ok := currentByKey[key]; !ok {
+			newChange("removed", key, "", previousByKey[key], nil, "")
+		}
+	}
+	for _, key := range currentKeys {
+		current := currentByKey[key]
+		actor := recordActor(table, current)
+		old, ok := previousByKey[key]
+		if !ok {
+			newChange("added", key, "", nil, current, actor)
+			continue
+		}
+		diffValues("", withoutFields(old, volatile), withoutFields(current, volatile), func(field string, oldValue interface{}, newValue interface{}) {
+			newChange("changed", key, field, oldValue, newValue, actor)
+		})
+	}
+	return changes
+}
+
+// recordActor returns the user who last changed record, from the first of the
+// collector's ActorFields that is set.
+func recordActor(table string, record Record) string {
+	for _, field := range collectorFor(table).ActorFields {
+		if actor := fieldString(record, field); actor != "" {
+			return actor
+		}
+	}
+	return ""
+}
+
+// diffValues walks nested objects and reports every field whose value
+// differs, using dotted paths. Arrays are compared as a whole.
+func diffValues(path string, old interface{}, new interface{}, report func(field string, oldValue interface{}, newValue interface{})) {
+	oldMap, oldIsMap := asMap(old)
+	newMap, newIsMap := asMap(new)
+	if !oldIsMap || !newIsMap {
+		if !reflect.DeepEqual(old, new) {
+			report(path, old, new)
+		}
+		return
+	}
+
+	fields := make(map[string]struct{})
+	for field := range oldMap {
+		fields[field] = struct{}{}
+	}
+	for field := range newMap {
+		fields[field] = struct{}{}
+	}
+	sorted := make([]string, 0, len(fields))
+	for field := range fields {
+		sorted = append(sorted, field)
+	}
+	sort.Strings(sorted)
+
+	for _, field := range sorted {
+		fieldPath := field
+		if path != "" {
+			fieldPath = path + "." + field
+		}
+		diffValues(fieldPath, oldMap[field], newMap[field], report)
+	}
+}
+
+// withoutFields returns a copy of record without the given top-level fields.
+func withoutFields(record Record, fields []string) Record {
+	if len(fields) == 0 {
+		return record
+	}
+	trimmed := make(Record, len(record))
+	for field, value := range record {
+		trimmed[field] = value
+	}
+	for _, field := range fields {
+		delete(trimmed, field)
+	}
+	return trimmed
+}
+
+func asMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case Record:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	}
+	return nil, false
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	previous := []Record{
+		{"id": "1", "action": "Alert", "lastUpdatedBy": "alice"},
+		{"id": "2", "action": "Block"},
+		{"id": "3", "action": "Allowed", "rbacGroupNames": []interface{}{"a"}},
+	}
+	current := []Record{
+		{"id": "1", "action": "Block", "lastUpdatedBy": "bob"},
+		{"id": "3", "action": "Allowed", "rbacGroupNames": []interface{}{"a", "b"}},
+		{"id": "4", "action": "Audit", "createdBy": "carol"},
+	}
+
+	changes := diffSnapshots("MdeIndicators", previous, current)
+
+	type change struct {
+		changeType, key, field string
+		oldValue, newValue     interface{}
+		actor                  interface{}
+	}
+	var got []change
+	for _, c := range changes {
+		if c["SourceTable"] != "MdeIndicators" {
+			t.Errorf("change %v has the wrong SourceTable", c)
+		}
+		got = append(got, change{c["ChangeType"].(string), c["RecordKey"].(string), c["Field"].(string), c["OldValue"], c["NewValue"], c["ChangedBy"]})
+	}
+	want := []change{
+		{"removed", "id=2", "", previous[1], nil, nil},
+		{"changed", "id=1", "action", "Alert", "Block", "bob"},
+		{"changed", "id=1", "lastUpdatedBy", "alice", "bob", "bob"},
+		{"changed", "id=3", "rbacGroupNames", []interface{}{"a"}, []interface{}{"a", "b"}, nil},
+		{"added", "id=4", "", nil, current[2], "carol"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestDiffSnapshotsIgnoresVolatileFields(t *testing.T) {
+	previous := []Record{{"Id": 7, "Name": "rule", "LastRunTime": "2024-03-05T10:00:00Z", "LastRunStatus": "Completed"}}
+	current := []Record{{"Id": 7, "Name": "rule", "LastRunTime": "2024-03-05T11:00:00Z", "LastRunStatus": "Running"}}
+
+	if changes := diffSnapshots("MdeCustomDetectionState", previous, current); len(changes) != 0 {
+		t.Errorf("volatile fields reported as changes: %v", changes)
+	}
+
+	current[0]["Name"] = "renamed rule"
+	changes := diffSnapshots("MdeCustomDetectionState", previous, current)
+	if len(changes) != 1 || changes[0]["Field"] != "Name" {
+		t.Errorf("changes %v, want only Name", changes)
+	}
+}
+
+func TestDiffSnapshotsDuplicateKeys(t *testing.T) {
+	previous := []Record{{"id": "1", "action": "Alert"}}
+	current := []Record{{"id": "1", "action": "Audit"}, {"id": "1", "action": "Block"}}
+
+	changes := diffSnapshots("MdeIndicators", previous, current)
+	if len(changes) != 1 || changes[0]["NewValue"] != "Block" {
+		t.Errorf("changes %v, want a single change to the last record", changes)
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	old := map[string]interface{}{
+		"name": "policy",
+		"settings": map[string]interface{}{
+			"enabled": true,
+			"scan":    map[string]interface{}{"day": "Monday", "hour": float64(2)},
+			"removed": "x",
+		},
+	}
+	new := map[string]interface{}{
+		"name": "policy",
+		"settings": map[string]interface{}{
+			"enabled": false,
+			"scan":    map[string]interface{}{"day": "Monday", "hour": float64(3)},
+			"added":   "y",
+		},
+	}
+
+	var got [][3]interface{}
+	diffValues("", old, new, func(field string, oldValue interface{}, newValue interface{}) {
+		got = append(got, [3]interface{}{field, oldValue, newValue})
+	})
+	want := [][3]interface{}{
+		{"settings.added", nil, "y"},
+		{"settings.enabled", true, false},
+		{"settings.removed", "x", nil},
+		{"settings.scan.hour", float64(2), float64(3)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("differences %v, want %v", got, want)
+	}
+}
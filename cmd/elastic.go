@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// elasticBulkSize is the number of documents sent per _bulk request.
+const elasticBulkSize = 1000
+
+const defaultElasticIndex = "defenderharvester-{table}-{date}"
+
+type elasticBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// SendToElastic indexes records into Elasticsearch or OpenSearch through the
+// _bulk API. Documents are indexed under their RecordId, so sending the same
+// records again overwrites instead of duplicating them.
+func SendToElastic(records []Record, table string) error {
+	elasticUri := strings.TrimRight(os.Getenv("ElasticUri"), "/")
+	if elasticUri == "" {
+		return fmt.Errorf("ElasticUri is not set")
+	}
+	indexPattern := elasticIndexPattern(table)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	if os.Getenv("ElasticInsecure") == "true" {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	log.Println("↳ Sending data to Elasticsearch for table:", table)
+	for start := 0; start < len(records); start += elasticBulkSize {
+		end := start + elasticBulkSize
+		if end > len(records) {
+			end = len(records)
+		}
+		if err := elasticBulk(client, elasticUri, indexPattern, table, records[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// elasticIndexPattern returns the index name pattern of table: ElasticIndex_<table>
+// when set, otherwise ElasticIndex or the default pattern.
+func elasticIndexPattern(table string) string {
+	for _, name := range []string{"ElasticIndex_" + table, "ElasticIndex"} {
+		if pattern := os.Getenv(name); pattern != "" {
+			return pattern
+		}
+	}
+	return defaultElasticIndex
+}
+
+// elasticBulk sends one _bulk request. Documents rejected with 429 are sent
+// again, any other item error fails the batch.
+func elasticBulk(client *http.Client, elasticUri string, indexPattern string, table string, records []Record) error {
+	pending := records
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var body bytes.Buffer
+		for _, record := range pending {
+			action := map[string]map[string]string{
+				"index": {
+					"_index": strings.ToLower(expandName(indexPattern, table, recordTimeGenerated(record))),
+				},
+			}
+			if id, ok := record["RecordId"].(string); ok && id != "" {
+				action["index"]["_id"] = id
+			}
+			line, err := json.Marshal(action)
+			if err != nil {
+				return err
+			}
+			doc, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("failed to marshal document: %w", err)
+			}
+			body.Write(line)
+			body.WriteByte('\n')
+			body.Write(doc)
+			body.WriteByte('\n')
+		}
+
+		resp, err := doWithRetry(client, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPost, elasticUri+"/_bulk", bytes.NewReader(body.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/x-ndjson")
+			if apiKey := os.Getenv("ElasticApiKey"); apiKey != "" {
+				req.Header.Set("Authorization", "ApiKey "+apiKey)
+			} else if username := os.Getenv("ElasticUsername"); username != "" {
+				req.SetBasicAuth(username, os.Getenv("ElasticPassword"))
+			}
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read bulk response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("bulk request failed with status code %s: %s", resp.Status, respBody)
+		}
+
+		var result elasticBulkResponse
+		if err := json.Unmarshal(respBody, &result); err != nil {
+			return fmt.Errorf("failed to parse bulk response: %w", err)
+		}
+		if !result.Errors {
+			return nil
+		}
+
+		var throttled []Record
+		var failed int
+		var firstError string
+		for i, item := range result.Items {
+			for _, status := range item {
+				if status.Error == nil {
+					continue
+				}
+				if status.Status == http.StatusTooManyRequests && i < len(pending) {
+					throttled = append(throttled, pending[i])
+					continue
+				}
+				failed++
+				if firstError == "" {
+					firstError = fmt.Sprintf("%s: %s", status.Error.Type, status.Error.Reason)
+				}
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d documents were rejected, first error: %s", failed, len(pending), firstError)
+		}
+		if attempt == maxAttempts && len(throttled) > 0 {
+			return fmt.Errorf("%d documents were still throttled after %d attempts", len(throttled), attempt)
+		}
+		if len(throttled) > 0 {
+			log.Printf("%d documents were throttled, sending them again\n", len(throttled))
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		pending = throttled
+	}
+	return nil
+}
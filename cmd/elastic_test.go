@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bulkRequest is a _bulk request received by the stand-in server.
+type bulkRequest struct {
+	Header  http.Header
+	Actions []map[string]map[string]string
+	Docs    []Record
+}
+
+// elasticEnvVars are cleared for every test, so the environment running the
+// tests does not change the results.
+var elasticEnvVars = []string{"ElasticIndex", "ElasticApiKey", "ElasticUsername", "ElasticPassword", "ElasticInsecure"}
+
+// elasticServer is a stand-in Elasticsearch recording the _bulk requests it
+// receives.
+type elasticServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []bulkRequest
+}
+
+// newElasticServer starts an elasticServer answering with respond, which gets
+// the request number starting at 1. env is set on top of the cleared
+// elasticEnvVars.
+func newElasticServer(t *testing.T, env map[string]string, respond func(n int, req bulkRequest, w http.ResponseWriter)) *elasticServer {
+	t.Helper()
+	for _, name := range elasticEnvVars {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	s := &elasticServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		req := bulkRequest{Header: r.Header.Clone()}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				t.Errorf("invalid action line: %v", err)
+			}
+			if !scanner.Scan() {
+				t.Errorf("action without document")
+				break
+			}
+			var doc Record
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				t.Errorf("invalid document line: %v", err)
+			}
+			req.Actions = append(req.Actions, action)
+			req.Docs = append(req.Docs, doc)
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		n := len(s.requests)
+		s.mu.Unlock()
+		respond(n, req, w)
+	}))
+	t.Cleanup(s.Close)
+	t.Setenv("ElasticUri", s.URL)
+	return s
+}
+
+// bulkOK answers every document as created.
+func bulkOK(_ int, req bulkRequest, w http.ResponseWriter) {
+	writeBulkResponse(w, req, func(int) (int, string) { return http.StatusCreated, "" })
+}
+
+// writeBulkResponse answers a bulk request with the status and error type
+// item returns for each document.
+func writeBulkResponse(w http.ResponseWriter, req bulkRequest, item func(i int) (int, string)) {
+	var errors bool
+	items := make([]map[string]interface{}, 0, len(req.Actions))
+	for i, action := range req.Actions {
+		status, errorType := item(i)
+		result := map[string]interface{}{"_id": action["index"]["_id"], "status": status}
+		if errorType != "" {
+			errors = true
+			result["error"] = map[string]string{"type": errorType, "reason": "rejected by test"}
+		}
+		items = append(items, map[string]interface{}{"index": result})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors, "items": items})
+}
+
+func elasticRecords(n int) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		records[i] = Record{
+			"RecordId":      fmt.Sprintf("id-%d", i),
+			"TimeGenerated": "2024-03-05T10:00:00Z",
+		}
+	}
+	return records
+}
+
+func TestSendToElasticUsesRecordIdAsDocumentId(t *testing.T) {
+	server := newElasticServer(t, nil, bulkOK)
+
+	if err := SendToElastic(elasticRecords(3), "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(server.requests))
+	}
+	if got := server.requests[0].Header.Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	for i, action := range server.requests[0].Actions {
+		if want := fmt.Sprintf("id-%d", i); action["index"]["_id"] != want {
+			t.Errorf("document %d has _id %q, want %q", i, action["index"]["_id"], want)
+		}
+	}
+}
+
+func TestSendToElasticIndexNames(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		table string
+		want  string
+	}{
+		{"default", nil, "MdeTimeline", "defenderharvester-mdetimeline-2024.03.05"},
+		{"default other table", nil, "MdeMachineActions", "defenderharvester-mdemachineactions-2024.03.05"},
+		{"global pattern", map[string]string{"ElasticIndex": "mde-{table}-{day}"}, "MdeIndicators", "mde-mdeindicators-2024-03-05"},
+		{"table override", map[string]string{"ElasticIndex": "mde-{table}", "ElasticIndex_MdeTimeline": "timeline-{day}-{hour}"}, "MdeTimeline", "timeline-2024-03-05-10"},
+		{"override of another table", map[string]string{"ElasticIndex": "mde-{table}", "ElasticIndex_MdeTimeline": "timeline"}, "MdeRoles", "mde-mderoles"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newElasticServer(t, test.env, bulkOK)
+
+			if err := SendToElastic(elasticRecords(1), test.table); err != nil {
+				t.Fatal(err)
+			}
+			if got := server.requests[0].Actions[0]["index"]["_index"]; got != test.want {
+				t.Errorf("index = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSendToElasticAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"api key", map[string]string{"ElasticApiKey": "c2VjcmV0", "ElasticUsername": "ignored"}, "ApiKey c2VjcmV0"},
+		{"basic", map[string]string{"ElasticUsername": "harvester", "ElasticPassword": "secret"}, "Basic aGFydmVzdGVyOnNlY3JldA=="},
+		{"none", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newElasticServer(t, test.env, bulkOK)
+
+			if err := SendToElastic(elasticRecords(1), "MdeTimeline"); err != nil {
+				t.Fatal(err)
+			}
+			if got := server.requests[0].Header.Get("Authorization"); got != test.want {
+				t.Errorf("Authorization = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSendToElasticItemFailure(t *testing.T) {
+	server := newElasticServer(t, nil, func(_ int, req bulkRequest, w http.ResponseWriter) {
+		writeBulkResponse(w, req, func(i int) (int, string) {
+			if i == 1 {
+				return http.StatusBadRequest, "mapper_parsing_exception"
+			}
+			return http.StatusCreated, ""
+		})
+	})
+
+	err := SendToElastic(elasticRecords(3), "MdeTimeline")
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 documents were rejected") || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Fatalf("got error %v, want the rejected document reported", err)
+	}
+	if len(server.requests) != 1 {
+		t.Errorf("got %d requests, want 1", len(server.requests))
+	}
+}
+
+func TestSendToElasticResendsThrottledItems(t *testing.T) {
+	server := newElasticServer(t, nil, func(n int, req bulkRequest, w http.ResponseWriter) {
+		writeBulkResponse(w, req, func(i int) (int, string) {
+			if n == 1 && i == 2 {
+				return http.StatusTooManyRequests, "es_rejected_execution_exception"
+			}
+			return http.StatusCreated, ""
+		})
+	})
+
+	if err := SendToElastic(elasticRecords(3), "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(server.requests))
+	}
+	resent := server.requests[1].Actions
+	if len(resent) != 1 || resent[0]["index"]["_id"] != "id-2" {
+		t.Errorf("resent %v, want only id-2", resent)
+	}
+}
+
+func TestSendToElasticRetriesStatus(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			server := newElasticServer(t, nil, func(n int, req bulkRequest, w http.ResponseWriter) {
+				if n == 1 {
+					w.Header().Set("Retry-After", "0")
+					w.WriteHeader(status)
+					return
+				}
+				bulkOK(n, req, w)
+			})
+
+			if err := SendToElastic(elasticRecords(2), "MdeTimeline"); err != nil {
+				t.Fatal(err)
+			}
+			if len(server.requests) != 2 {
+				t.Fatalf("got %d requests, want 2", len(server.requests))
+			}
+			if len(server.requests[1].Docs) != 2 {
+				t.Errorf("retry sent %d documents, want 2", len(server.requests[1].Docs))
+			}
+		})
+	}
+}
+
+func TestSendToElasticFailsAfterRetries(t *testing.T) {
+	server := newElasticServer(t, nil, func(_ int, _ bulkRequest, w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	if err := SendToElastic(elasticRecords(1), "MdeTimeline"); err == nil {
+		t.Fatal("got no error for a server that keeps failing")
+	}
+	if len(server.requests) != maxAttempts {
+		t.Errorf("got %d requests, want %d", len(server.requests), maxAttempts)
+	}
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"strings"
+	"time"
+)
+
+// timeLayouts are the timestamp formats seen across the service API.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.9999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	time.RFC1123,
+}
+
+// Enrich adds the harvest metadata to each record: when, from where and by
+// which harvester version it was collected, plus a normalized TimeGenerated
+// taken from the record's own event time.
+func Enrich(cfg Config, table string, endpoint string, records []Record) {
+	harvestTime := cfg.HarvestTime
+	if harvestTime.IsZero() {
+		harvestTime = time.Now()
+	}
+	harvestTime = harvestTime.UTC()
+
+	source := endpoint
+	if i := strings.Index(source, "?"); i >= 0 {
+		source = source[:i]
+	}
+
+	timeFields := append(collectorFor(table).TimeFields, defaultTimeFields...)
+	for _, record := range records {
+		record["HarvestTime"] = harvestTime.Format(time.RFC3339Nano)
+		record["TenantId"] = cfg.TenantID
+		record["Region"] = cfg.Region
+		record["SourceEndpoint"] = source
+		record["CollectorName"] = table
+		record["HarvesterVersion"] = cfg.HarvesterVersion
+
+		eventTime, ok := recordTime(record, timeFields)
+		if !ok {
+			eventTime = harvestTime
+		}
+		record["TimeGenerated"] = eventTime.Format(time.RFC3339Nano)
+	}
+}
+
+// recordTime returns the first of fields that holds a parseable timestamp.
+func recordTime(record Record, fields []string) (time.Time, bool) {
+	for _, field := range fields {
+		value, ok := record[field].(string)
+		if !ok || value == "" {
+			continue
+		}
+		if t, ok := parseTime(value); ok {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func parseTime(value string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
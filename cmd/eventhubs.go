@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs"
+)
+
+const (
+	// eventHubsTimeout bounds how long a table may take to be sent.
+	eventHubsTimeout = 5 * time.Minute
+	// eventHubsConcurrency is the number of partition keys sent at once. A
+	// batch only holds events of one partition key, so with many machines
+	// sending the keys one by one would take a round trip per machine.
+	eventHubsConcurrency = 16
+)
+
+// SendToEventHubs sends records to an Event Hub in batches that stay within
+// the size limit of the hub. Records are grouped by partition key, the
+// MachineId or TenantId depending on EventHubPartitionKey, and the groups are
+// sent concurrently. Every event carries the table name as an application
+// property.
+func SendToEventHubs(records []Record, table string) error {
+	client, err := newEventHubsProducer()
+	if err != nil {
+		return err
+	}
+	defer client.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventHubsTimeout)
+	defer cancel()
+
+	groups := make(map[string][]Record)
+	for _, record := range records {
+		key := eventHubsPartitionKey(record)
+		groups[key] = append(groups[key], record)
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	log.Println("↳ Sending data to Event Hubs for table:", table)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		batches  int
+		firstErr error
+	)
+	slots := make(chan struct{}, eventHubsConcurrency)
+	for _, key := range keys {
+		slots <- struct{}{}
+		if ctx.Err() != nil {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			sent, err := sendEventHubsGroup(ctx, client, key, groups[key], table)
+			mu.Lock()
+			defer mu.Unlock()
+			batches += sent
+			if err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}(key)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to send to Event Hubs: %w", err)
+	}
+	log.Printf("Sent %d events in %d batches\n", len(records), batches)
+	return nil
+}
+
+func newEventHubsProducer() (*azeventhubs.ProducerClient, error) {
+	eventHub := os.Getenv("EventHubName")
+	if connectionString := os.Getenv("EventHubConnectionString"); connectionString != "" {
+		client, err := azeventhubs.NewProducerClientFromConnectionString(connectionString, eventHub, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Event Hubs client: %w", err)
+		}
+		return client, nil
+	}
+
+	namespace := os.Getenv("EventHubNamespace")
+	if namespace == "" || eventHub == "" {
+		return nil, fmt.Errorf("set EventHubConnectionString, or EventHubNamespace and EventHubName")
+	}
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create credential: %w", err)
+	}
+	client, err := azeventhubs.NewProducerClient(namespace, eventHub, credential, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Event Hubs client: %w", err)
+	}
+	return client, nil
+}
+
+// eventHubsPartitionKey returns the partition key for a record, or an empty
+// string to let the service spread the events over all partitions.
+func eventHubsPartitionKey(record Record) string {
+	var field string
+	switch strings.ToLower(os.Getenv("EventHubPartitionKey")) {
+	case "", "machine":
+		field = "MachineId"
+	case "tenant":
+		field = "TenantId"
+	default:
+		return ""
+	}
+	if value, ok := record[field]; ok && value != nil {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+// sendEventHubsGroup sends records sharing a partition key, starting a new
+// batch whenever the current one is full. It returns the number of batches sent.
+func sendEventHubsGroup(ctx context.Context, client *azeventhubs.ProducerClient, key string, records []Record, table string) (int, error) {
+	options := &azeventhubs.EventDataBatchOptions{}
+	if key != "" {
+		options.PartitionKey = &key
+	}
+
+	var sent int
+	batch, err := client.NewEventDataBatch(ctx, options)
+	if err != nil {
+		return sent, fmt.Errorf("failed to create batch: %w", err)
+	}
+
+	for _, record := range records {
+		body, err := json.Marshal(record)
+		if err != nil {
+			return sent, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		event := &azeventhubs.EventData{
+			Body:        body,
+			ContentType: stringPtr("application/json"),
+			Properties: map[string]any{
+				"Table":    table,
+				"TenantId": record["TenantId"],
+			},
+		}
+
+		err = batch.AddEventData(event, nil)
+		if errors.Is(err, azeventhubs.ErrEventDataTooLarge) {
+			if batch.NumEvents() == 0 {
+				return sent, fmt.Errorf("record %v is larger than the Event Hubs message limit", record["RecordId"])
+			}
+			if err := client.SendEventDataBatch(ctx, batch, nil); err != nil {
+				return sent, fmt.Errorf("failed to send batch: %w", err)
+			}
+			sent++
+			if batch, err = client.NewEventDataBatch(ctx, options); err != nil {
+				return sent, fmt.Errorf("failed to create batch: %w", err)
+			}
+			err = batch.AddEventData(event, nil)
+		}
+		if err != nil {
+			return sent, fmt.Errorf("failed to add event to batch: %w", err)
+		}
+	}
+
+	if batch.NumEvents() > 0 {
+		if err := client.SendEventDataBatch(ctx, batch, nil); err != nil {
+			return sent, fmt.Errorf("failed to send batch: %w", err)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Column kinds inferred from the record values.
+const (
+	kindString = "string"
+	kindNumber = "number"
+	kindBool   = "bool"
+)
+
+// flattenRecords turns records into rows of scalar columns. Nested objects
+// become dotted columns when flatten is set and JSON strings otherwise;
+// arrays are always kept as JSON strings.
+func flattenRecords(records []Record, flatten bool) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		row := make(map[string]interface{}, len(record))
+		flattenInto(row, "", record, flatten)
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func flattenInto(row map[string]interface{}, prefix string, object map[string]interface{}, flatten bool) {
+	for field, value := range object {
+		column := field
+		if prefix != "" {
+			column = prefix + "." + field
+		}
+		switch v := value.(type) {
+		case string, float64, bool, nil:
+			row[column] = v
+		case map[string]interface{}:
+			if flatten {
+				flattenInto(row, column, v, flatten)
+				continue
+			}
+			row[column] = jsonString(v)
+		default:
+			row[column] = jsonString(v)
+		}
+	}
+}
+
+func jsonString(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+// inferColumns returns the columns to write, the selected ones or all columns
+// sorted by name, and their kind. A column holding mixed types is a string.
+func inferColumns(rows []map[string]interface{}, selected []string) ([]string, map[string]string) {
+	kinds := make(map[string]string)
+	for _, row := range rows {
+		for column, value := range row {
+			var kind string
+			switch value.(type) {
+			case nil:
+				if _, ok := kinds[column]; !ok {
+					kinds[column] = ""
+				}
+				continue
+			case float64:
+				kind = kindNumber
+			case bool:
+				kind = kindBool
+			default:
+				kind = kindString
+			}
+			if existing := kinds[column]; existing != "" && existing != kind {
+				kind = kindString
+			}
+			kinds[column] = kind
+		}
+	}
+
+	columns := selected
+	if len(columns) == 0 {
+		for column := range kinds {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+	}
+	for _, column := range columns {
+		if kinds[column] == "" {
+			kinds[column] = kindString
+		}
+	}
+	return columns, kinds
+}
+
+// cellValue converts a row value to the kind of its column.
+func cellValue(value interface{}, kind string) interface{} {
+	if value == nil {
+		return nil
+	}
+	if kind != kindString {
+		return value
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return jsonString(value)
+}
+
+// writeCSV appends records to the CSV file, writing the header when the file
+// is new. When the columns differ from the header of the existing file, that
+// file is moved aside first.
+func writeCSV(records []Record, dir string, stem string, ext string, opts FileOptions) error {
+	if err := rotateFile(dir, stem, ext, opts.RotateBytes); err != nil {
+		return err
+	}
+
+	rows := flattenRecords(records, opts.Flatten)
+	columns, _ := inferColumns(rows, opts.Columns)
+	filename := filepath.Join(dir, stem+ext)
+
+	header, err := csvHeader(filename, opts.Compression)
+	if err != nil {
+		return err
+	}
+	if header != nil && !equalStrings(header, columns) {
+		if err := moveAside(dir, stem, ext); err != nil {
+			return err
+		}
+		header = nil
+	}
+
+	var buf bytes.Buffer
+	w, err := newCompressor(&buf, opts.Compression)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	if header == nil {
+		cw.Write(columns)
+	}
+	for _, row := range rows {
+		line := make([]string, len(columns))
+		for i, column := range columns {
+			if value := cellValue(row[column], kindString); value != nil {
+				line[i] = value.(string)
+			}
+		}
+		cw.Write(line)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to encode CSV: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to compress records: %w", err)
+	}
+
+	log.Printf("↳ Writing %d events to %s\n", len(records), filename)
+	return appendFile(filename, buf.Bytes())
+}
+
+// csvHeader returns the header of an existing CSV file, or nil when there is
+// no file yet.
+func csvHeader(filename string, compression string) ([]string, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch compression {
+	case "gzip":
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	header, err := csv.NewReader(r).Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the header of %s: %w", filename, err)
+	}
+	return header, nil
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeParquet writes records to a new Parquet file, with a schema inferred
+// from the record shape: every column is optional and holds a string, double
+// or boolean.
+func writeParquet(records []Record, dir string, stem string, opts FileOptions) error {
+	rows := flattenRecords(records, opts.Flatten)
+	columns, kinds := inferColumns(rows, opts.Columns)
+
+	group := make(parquet.Group, len(columns))
+	for _, column := range columns {
+		switch kinds[column] {
+		case kindNumber:
+			group[column] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		case kindBool:
+			group[column] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+		default:
+			group[column] = parquet.Optional(parquet.String())
+		}
+	}
+	schema := parquet.NewSchema(stem, group)
+
+	var codec parquet.WriterOption
+	switch opts.Compression {
+	case "", "none":
+		codec = parquet.Compression(&parquet.Uncompressed)
+	case "gzip":
+		codec = parquet.Compression(&parquet.Gzip)
+	case "zstd":
+		codec = parquet.Compression(&parquet.Zstd)
+	default:
+		return fmt.Errorf("unsupported compression %q, use none, gzip or zstd", opts.Compression)
+	}
+
+	filename := filepath.Join(dir, stem+".parquet")
+	if _, err := os.Stat(filename); err == nil {
+		filename = freeName(dir, stem, ".parquet")
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := parquet.NewWriter(tmp, schema, codec)
+	for _, row := range rows {
+		values := make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			values[column] = cellValue(row[column], kinds[column])
+		}
+		if err := writer.Write(values); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write Parquet row: %w", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write Parquet file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+
+	log.Printf("↳ Writing %d events to %s\n", len(records), filename)
+	return os.Rename(tmp.Name(), filename)
+}
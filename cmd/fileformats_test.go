@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// readParquetRows returns the rows of file keyed by column name.
+func readParquetRows(t *testing.T, file *parquet.File) []map[string]interface{} {
+	t.Helper()
+	columns := file.Schema().Columns()
+	var rows []map[string]interface{}
+	for _, group := range file.RowGroups() {
+		reader := group.Rows()
+		buf := make([]parquet.Row, 16)
+		for {
+			n, err := reader.ReadRows(buf)
+			for _, row := range buf[:n] {
+				values := make(map[string]interface{}, len(columns))
+				for _, value := range row {
+					name := strings.Join(columns[value.Column()], ".")
+					switch {
+					case value.IsNull():
+						values[name] = nil
+					case value.Kind() == parquet.Double:
+						values[name] = value.Double()
+					case value.Kind() == parquet.Boolean:
+						values[name] = value.Boolean()
+					default:
+						values[name] = string(value.ByteArray())
+					}
+				}
+				rows = append(rows, values)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		reader.Close()
+	}
+	return rows
+}
+
+// formatRecords are decoded from JSON, like the records the sinks receive.
+func formatRecords(t *testing.T) []Record {
+	t.Helper()
+	records, err := DecodeRecords([]byte(`[
+		{"Id": 1, "Name": "a", "Enabled": true, "Mixed": 1, "Device": {"Name": "host-1", "Os": {"Build": 22631}}, "Tags": ["x", "y"]},
+		{"Id": 2.5, "Name": "b", "Enabled": false, "Mixed": "two", "Device": {"Name": "host-2"}, "Empty": null}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestInferColumns(t *testing.T) {
+	rows := flattenRecords(formatRecords(t), false)
+	columns, kinds := inferColumns(rows, nil)
+
+	wantColumns := []string{"Device", "Empty", "Enabled", "Id", "Mixed", "Name", "Tags"}
+	if !reflect.DeepEqual(columns, wantColumns) {
+		t.Errorf("columns %v, want %v", columns, wantColumns)
+	}
+	wantKinds := map[string]string{
+		"Device":  kindString,
+		"Empty":   kindString,
+		"Enabled": kindBool,
+		"Id":      kindNumber,
+		"Mixed":   kindString,
+		"Name":    kindString,
+		"Tags":    kindString,
+	}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Errorf("kinds %v, want %v", kinds, wantKinds)
+	}
+
+	selected, _ := inferColumns(rows, []string{"Name", "Missing", "Id"})
+	if !reflect.DeepEqual(selected, []string{"Name", "Missing", "Id"}) {
+		t.Errorf("selected columns %v, want the selection in its order", selected)
+	}
+}
+
+func readCSV(t *testing.T, filename string) [][]string {
+	t.Helper()
+	rows, err := csv.NewReader(strings.NewReader(readFile(t, filename, ""))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestWriteCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		opts FileOptions
+		want [][]string
+	}{
+		{
+			name: "nested objects as JSON",
+			want: [][]string{
+				{"Device", "Empty", "Enabled", "Id", "Mixed", "Name", "Tags"},
+				{`{"Name":"host-1","Os":{"Build":22631}}`, "", "true", "1", "1", "a", `["x","y"]`},
+				{`{"Name":"host-2"}`, "", "false", "2.5", "two", "b", ""},
+			},
+		},
+		{
+			name: "flattened",
+			opts: FileOptions{Flatten: true},
+			want: [][]string{
+				{"Device.Name", "Device.Os.Build", "Empty", "Enabled", "Id", "Mixed", "Name", "Tags"},
+				{"host-1", "22631", "", "true", "1", "1", "a", `["x","y"]`},
+				{"host-2", "", "", "false", "2.5", "two", "b", ""},
+			},
+		},
+		{
+			name: "selected columns",
+			opts: FileOptions{Flatten: true, Columns: []string{"Name", "Device.Os.Build", "Missing"}},
+			want: [][]string{
+				{"Name", "Device.Os.Build", "Missing"},
+				{"a", "22631", ""},
+				{"b", "", ""},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			opts.Dir, opts.Name, opts.Format = t.TempDir(), "{table}", "csv"
+			if err := WriteToFiles(formatRecords(t), "MdeTimeline", opts); err != nil {
+				t.Fatal(err)
+			}
+			if rows := readCSV(t, filepath.Join(opts.Dir, "MdeTimeline.csv")); !reflect.DeepEqual(rows, test.want) {
+				t.Errorf("rows\n%q\nwant\n%q", rows, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteParquet(t *testing.T) {
+	dir := t.TempDir()
+	opts := FileOptions{Dir: dir, Name: "{table}", Format: "parquet", Flatten: true, Compression: "zstd"}
+	for i := 0; i < 2; i++ {
+		if err := WriteToFiles(formatRecords(t), "MdeTimeline", opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files := dirFiles(t, dir); !reflect.DeepEqual(files, []string{"MdeTimeline.1.parquet", "MdeTimeline.parquet"}) {
+		t.Fatalf("files %v, want a numbered file per write", files)
+	}
+
+	filename := filepath.Join(dir, "MdeTimeline.parquet")
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]string)
+	for _, field := range file.Schema().Fields() {
+		if !field.Optional() {
+			t.Errorf("column %s is not optional", field.Name())
+		}
+		types[field.Name()] = field.Type().String()
+	}
+	wantTypes := map[string]string{
+		"Device.Name":     "STRING",
+		"Device.Os.Build": "DOUBLE",
+		"Empty":           "STRING",
+		"Enabled":         "BOOLEAN",
+		"Id":              "DOUBLE",
+		"Mixed":           "STRING",
+		"Name":            "STRING",
+		"Tags":            "STRING",
+	}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Errorf("column types %v, want %v", types, wantTypes)
+	}
+
+	rows := readParquetRows(t, file)
+	if len(rows) != 2 {
+		t.Fatalf("read %d rows, want 2", len(rows))
+	}
+	want := map[string]interface{}{
+		"Device.Name":     "host-1",
+		"Device.Os.Build": float64(22631),
+		"Empty":           nil,
+		"Enabled":         true,
+		"Id":              float64(1),
+		"Mixed":           "1",
+		"Name":            "a",
+		"Tags":            `["x","y"]`,
+	}
+	if !reflect.DeepEqual(rows[0], want) {
+		t.Errorf("first row %v, want %v", rows[0], want)
+	}
+	if rows[1]["Mixed"] != "two" || rows[1]["Device.Os.Build"] != nil {
+		t.Errorf("second row %v", rows[1])
+	}
+}
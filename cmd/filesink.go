@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultFileName writes one file per table per day.
+const DefaultFileName = "{table}-{day}"
+
+// FileOptions configures the file sink.
+type FileOptions struct {
+	// Dir is the output directory, created with 0700 permissions.
+	Dir string
+	// Name is the file name without extension. The {table}, {date}, {day}
+	// and {hour} placeholders are filled with the write time, so including
+	// {hour} rotates the files hourly.
+	Name string
+	// RotateBytes starts a new file once the current one reaches this size,
+	// zero disables size based rotation.
+	RotateBytes int64
+	// Compression is none, gzip or zstd.
+	Compression string
+	// Format is ndjson, csv or parquet.
+	Format string
+	// Columns selects and orders the CSV and Parquet columns, all columns
+	// of the records by default.
+	Columns []string
+	// Flatten writes nested objects as dotted CSV and Parquet columns
+	// instead of JSON strings.
+	Flatten bool
+}
+
+// fileExtension returns the extension for the file format and compression.
+// Parquet compresses its pages itself.
+func (o FileOptions) fileExtension() string {
+	ext := ".ndjson"
+	switch o.Format {
+	case "csv":
+		ext = ".csv"
+	case "parquet":
+		return ".parquet"
+	}
+	switch o.Compression {
+	case "gzip":
+		ext += ".gz"
+	case "zstd":
+		ext += ".zst"
+	}
+	return ext
+}
+
+// WriteToFiles writes records to the current file of table. NDJSON and CSV
+// files are appended to by writing the current content and the new records
+// to a temporary file in the output directory, which is renamed over the
+// file, so readers never see a partial write. Gzip and zstd files get a new
+// compressed member per write, which decompresses as one stream. Parquet can
+// not be appended to, so every write creates a new numbered file.
+func WriteToFiles(records []Record, table string, opts FileOptions) error {
+	dir := opts.Dir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	name := opts.Name
+	if name == "" {
+		name = DefaultFileName
+	}
+	stem := expandName(name, table, time.Now())
+	if strings.ContainsAny(stem, `/\`) {
+		return fmt.Errorf("file name %q must not contain a path separator", stem)
+	}
+	ext := opts.fileExtension()
+	filename := filepath.Join(dir, stem+ext)
+
+	switch opts.Format {
+	case "", "ndjson":
+		if err := rotateFile(dir, stem, ext, opts.RotateBytes); err != nil {
+			return err
+		}
+		data, err := encodeNDJSON(records, opts.Compression)
+		if err != nil {
+			return err
+		}
+		log.Printf("↳ Writing %d events to %s\n", len(records), filename)
+		return appendFile(filename, data)
+	case "csv":
+		return writeCSV(records, dir, stem, ext, opts)
+	case "parquet":
+		return writeParquet(records, dir, stem, opts)
+	}
+	return fmt.Errorf("unsupported file format %q, use ndjson, csv or parquet", opts.Format)
+}
+
+// encodeNDJSON renders records one JSON document per line, compressed as a
+// single gzip or zstd member.
+func encodeNDJSON(records []Record, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newCompressor(&buf, compression)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, fmt.Errorf("failed to encode record: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress records: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// newCompressor wraps w in a gzip or zstd writer. Closing it ends the
+// compressed member but leaves w open.
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", "none":
+		return nopCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported compression %q, use none, gzip or zstd", compression)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// rotateFile moves the current file aside to the first free numbered name,
+// e.g. MdeTimeline-2026-10-19.1.ndjson, once it has grown past maxBytes.
+func rotateFile(dir string, stem string, ext string, maxBytes int64) error {
+	if maxBytes <= 0 {
+		return nil
+	}
+	filename := filepath.Join(dir, stem+ext)
+	info, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() < maxBytes) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", filename, err)
+	}
+	return moveAside(dir, stem, ext)
+}
+
+// moveAside renames the current file to the first free numbered name.
+func moveAside(dir string, stem string, ext string) error {
+	filename := filepath.Join(dir, stem+ext)
+	rotated := freeName(dir, stem, ext)
+	log.Printf("Rotating %s to %s\n", filename, rotated)
+	return os.Rename(filename, rotated)
+}
+
+// freeName returns the first of stem.1.ext, stem.2.ext, ... that does not exist.
+func freeName(dir string, stem string, ext string) string {
+	for seq := 1; ; seq++ {
+		name := filepath.Join(dir, fmt.Sprintf("%s.%d%s", stem, seq, ext))
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			return name
+		}
+	}
+}
+
+// appendFile replaces filename with its current content followed by data.
+// The copy is bounded by RotateBytes, after which a new file is started.
+func appendFile(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := copyExisting(tmp, filename); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return nil
+}
+
+// copyExisting copies filename to dst, when it exists.
+func copyExisting(dst io.Writer, filename string) error {
+	src, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer src.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", filename, err)
+	}
+	return nil
+}
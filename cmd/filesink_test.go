@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// readFile returns the decompressed content of a file written by the sink.
+func readFile(t *testing.T, filename string, compression string) string {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch compression {
+	case "gzip":
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", filename, err)
+	}
+	return string(data)
+}
+
+// dirFiles lists the files in dir, which must not hold temporary files.
+func dirFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestExpandName(t *testing.T) {
+	at := time.Date(2026, 10, 19, 7, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	tests := map[string]string{
+		"{table}-{day}":          "MdeTimeline-2026-10-19",
+		"{table}.{date}.{hour}":  "MdeTimeline.2026.10.19.05",
+		"defender/{table}":       "defender/MdeTimeline",
+		"{table}-{table}-{nope}": "MdeTimeline-MdeTimeline-{nope}",
+	}
+	for pattern, want := range tests {
+		if got := expandName(pattern, "MdeTimeline", at); got != want {
+			t.Errorf("expandName(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestWriteToFilesAppends(t *testing.T) {
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := FileOptions{Dir: dir, Name: "{table}", Compression: compression}
+			for _, records := range [][]Record{{{"n": 1}, {"n": 2}}, {{"n": 3}}} {
+				if err := WriteToFiles(records, "MdeTimeline", opts); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want := "MdeTimeline" + opts.fileExtension()
+			if files := dirFiles(t, dir); len(files) != 1 || files[0] != want {
+				t.Fatalf("files %v, want %s", files, want)
+			}
+			info, err := os.Stat(filepath.Join(dir, want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("file mode %v, want 0600", info.Mode().Perm())
+			}
+			if got := readFile(t, filepath.Join(dir, want), compression); got != "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n" {
+				t.Errorf("content %q", got)
+			}
+		})
+	}
+}
+
+func TestWriteToFilesRotates(t *testing.T) {
+	dir := t.TempDir()
+	opts := FileOptions{Dir: dir, Name: "{table}", RotateBytes: 20}
+	for i := 0; i < 4; i++ {
+		if err := WriteToFiles([]Record{{"n": i, "pad": "xxxx"}}, "MdeTimeline", opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := dirFiles(t, dir)
+	want := []string{"MdeTimeline.1.ndjson", "MdeTimeline.2.ndjson", "MdeTimeline.3.ndjson", "MdeTimeline.ndjson"}
+	if strings.Join(files, " ") != strings.Join(want, " ") {
+		t.Fatalf("files %v, want %v", files, want)
+	}
+	for i, name := range want {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, name), "")), &record); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if record["n"] != float64(i) {
+			t.Errorf("%s holds record %v, want n=%d", name, record, i)
+		}
+	}
+}
+
+func TestWriteToFilesRejectsPathInName(t *testing.T) {
+	opts := FileOptions{Dir: t.TempDir(), Name: "defender/{table}"}
+	if err := WriteToFiles([]Record{{"n": 1}}, "MdeTimeline", opts); err == nil {
+		t.Error("a name with a path separator was accepted")
+	}
+}
+
+func TestWriteCSVHeaderChange(t *testing.T) {
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := FileOptions{Dir: dir, Name: "{table}", Format: "csv", Compression: compression}
+			writes := [][]Record{
+				{{"a": "1", "b": "2"}},
+				{{"a": "3", "b": "4"}},
+				{{"a": "5", "c": "6"}},
+			}
+			for _, records := range writes {
+				if err := WriteToFiles(records, "MdeTimeline", opts); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ext := opts.fileExtension()
+			files := dirFiles(t, dir)
+			if len(files) != 2 || files[0] != "MdeTimeline.1"+ext || files[1] != "MdeTimeline"+ext {
+				t.Fatalf("files %v, want the old header moved aside", files)
+			}
+			tests := map[string][][]string{
+				"MdeTimeline.1" + ext: {{"a", "b"}, {"1", "2"}, {"3", "4"}},
+				"MdeTimeline" + ext:   {{"a", "c"}, {"5", "6"}},
+			}
+			for name, want := range tests {
+				rows, err := csv.NewReader(strings.NewReader(readFile(t, filepath.Join(dir, name), compression))).ReadAll()
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !equalRows(rows, want) {
+					t.Errorf("%s holds %v, want %v", name, rows, want)
+				}
+			}
+		})
+	}
+}
+
+func equalRows(a [][]string, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !equalStrings(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
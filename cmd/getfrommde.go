@@ -8,24 +8,17 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"time"
 )
 
-type MachineActions struct {
-	Value   []interface{} `json:"value"`
-	Results []interface{} `json:"Results"`
-}
-
-type MachineGroups struct {
-	Items []interface{} `json:"items"`
-}
+// browserUserAgent is the User-Agent the service API is requested with.
+const browserUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0 OS/10.0.22621"
 
-func GetDataFromMDE(accessToken string, endpoint string, queryParams string, sentinel bool, table string, files bool, splunk bool, debug bool, location string) error {
+func GetDataFromMDE(cfg Config, endpoint string, queryParams string, table string, location string) error {
 	resource := fmt.Sprintf("https://%s.securitycenter.windows.com", location)
 	url := resource + endpoint + queryParams
 
-	if debug {
+	if cfg.Debug {
 		log.Printf("Query data from: %s\n", url)
 	}
 
@@ -34,9 +27,9 @@ func GetDataFromMDE(accessToken string, endpoint string, queryParams string, sen
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Authorization", "Bearer "+cfg.AccessToken)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0 OS/10.0.22621")
+	req.Header.Set("User-Agent", browserUserAgent)
 
 	client := &http.Client{
 		Timeout: 10 * time.Second,
@@ -57,7 +50,7 @@ func GetDataFromMDE(accessToken string, endpoint string, queryParams string, sen
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	if debug {
+	if cfg.Debug {
 		var prettyJSON bytes.Buffer
 		err = json.Indent(&prettyJSON, body, "", "\t")
 		if err != nil {
@@ -67,169 +60,115 @@ func GetDataFromMDE(accessToken string, endpoint string, queryParams string, sen
 		fmt.Printf("%s\n", prettyJSON.Bytes())
 	}
 
-	if files {
-		runTime := time.Now().Format("20060102-150405")
-		filename := runTime + "-" + table + ".json"
-		log.Printf("↳ Writing to %s\n", filename)
-		err = os.WriteFile(filename, body, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to file: %w", err)
-		}
+	records, err := DecodeRecords(body)
+	if err != nil {
+		return err
 	}
 
-	if splunk && table == "MdeMachineActions" {
-		var ma MachineActions
-		if err := json.Unmarshal(body, &ma); err != nil {
-			return err
-		}
-		body, err = json.Marshal(ma.Results)
-		if err != nil {
-			return err
-		}
-		log.Printf("Sending events to Splunk\n")
-		err = PostToSplunk(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Splunk: %w", err)
-		}
-	} else if splunk && table == "MdeMachineGroups" {
-		var ma MachineGroups
-		if err := json.Unmarshal(body, &ma); err != nil {
-			return err
-		}
-		body, err = json.Marshal(ma.Items)
-		if err != nil {
-			return err
-		}
-		log.Printf("Sending events to Splunk\n")
-		err = PostToSplunk(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Splunk: %w", err)
-		}
-	} else if splunk && table != "" {
-		log.Printf("Sending events to Splunk\n")
-		err = PostToSplunk(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Splunk: %w", err)
-		}
-	} else {
-		return nil
+	return deliver(cfg, table, location+".securitycenter.windows.com"+endpoint, records)
+}
+
+// GetDataFromMDEAPI retrieves endpoint from the public API, following the
+// @odata.nextLink of every page.
+func GetDataFromMDEAPI(cfg Config, endpoint string, queryParams string, table string, location string) error {
+	resource := fmt.Sprintf("https://%s.securitycenter.windows.com", location)
+	records, err := fetchMDEPages(cfg, resource+endpoint+queryParams)
+	if err != nil {
+		return err
 	}
+	return deliver(cfg, table, location+".securitycenter.windows.com"+endpoint, records)
+}
 
-	if sentinel && table == "MdeMachineActions" {
-		var ma MachineActions
-		if err := json.Unmarshal(body, &ma); err != nil {
-			return err
-		}
-		body, err = json.Marshal(ma.Results)
+// fetchMDEPages returns the records of url and of the pages behind its
+// @odata.nextLink.
+func fetchMDEPages(cfg Config, url string) ([]Record, error) {
+	var records []Record
+	for url != "" {
+		body, err := fetchMDE(cfg, url)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = SendToSentinel(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Sentinel: %w", err)
-		}
-	} else if sentinel && table == "MdeMachineGroups" {
-		var ma MachineGroups
-		if err := json.Unmarshal(body, &ma); err != nil {
-			return err
-		}
-		body, err = json.Marshal(ma.Items)
-		if err != nil {
-			return err
+
+		if cfg.Debug {
+			var prettyJSON bytes.Buffer
+			err = json.Indent(&prettyJSON, body, "", "\t")
+			if err != nil {
+				log.Println("JSON parse error: ", err)
+				return nil, err
+			}
+			fmt.Printf("%s\n", prettyJSON.Bytes())
 		}
-		err = SendToSentinel(body, table)
+
+		page, err := DecodeRecords(body)
 		if err != nil {
-			return fmt.Errorf("failed to write response body to Sentinel: %w", err)
+			return nil, err
 		}
-	} else if sentinel && table != "" {
-		err = SendToSentinel(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Sentinel: %w", err)
+		records = append(records, page...)
+
+		url = nextLink(body)
+		if url != "" {
+			log.Printf("Running, retrieved %d records\n", len(records))
 		}
-	} else {
-		return nil
 	}
+	return records, nil
+}
 
-	return nil
+// fetchMDE sends an authenticated GET request to url and returns the response
+// body. Throttled requests are retried, since collectors that follow up on
+// every record quickly run into the API rate limits.
+func fetchMDE(cfg Config, url string) ([]byte, error) {
+	return fetch(cfg, url, "")
 }
 
-func GetDataFromMDEAPI(accessToken string, endpoint string, queryParams string, sentinel bool, table string, files bool, splunk bool, debug bool, location string) error {
-	resource := fmt.Sprintf("https://%s.securitycenter.windows.com", location)
-	url := resource + endpoint + queryParams
+// fetchServiceAPI is fetchMDE for service API urls, which are requested with
+// the browser User-Agent like GetDataFromMDE does.
+func fetchServiceAPI(cfg Config, url string) ([]byte, error) {
+	return fetch(cfg, url, browserUserAgent)
+}
 
-	if debug {
+func fetch(cfg Config, url string, userAgent string) ([]byte, error) {
+	if cfg.Debug {
 		log.Printf("Query data from: %s\n", url)
 	}
 
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Content-Type", "application/json")
-
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout: 30 * time.Second,
 	}
 
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+cfg.AccessToken)
+		req.Header.Set("Content-Type", "application/json")
+		if userAgent != "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		return req, nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed with status code %s", resp.Status)
+		return nil, &statusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	if debug {
-		var prettyJSON bytes.Buffer
-		err = json.Indent(&prettyJSON, body, "", "\t")
-		if err != nil {
-			log.Println("JSON parse error: ", err)
-			return err
-		}
-		fmt.Printf("%s\n", prettyJSON.Bytes())
-	}
-
-	if files {
-		runTime := time.Now().Format("20060102-150405")
-		filename := runTime + "-" + table + ".json"
-		log.Printf("↳ Writing to %s\n", filename)
-		err = os.WriteFile(filename, body, 0644)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to file: %w", err)
-		}
-	}
-
-	if splunk {
-		log.Printf("Sending events to Splunk\n")
-		err = PostToSplunk(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Splunk: %w", err)
-		}
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
+	return body, nil
+}
 
-	if sentinel && table != "" {
-		var ma MachineActions
-		if err := json.Unmarshal(body, &ma); err != nil {
-			return err
-		}
-		body, err = json.Marshal(ma.Value)
-		if err != nil {
-			return err
-		}
-		err = SendToSentinel(body, table)
-		if err != nil {
-			return fmt.Errorf("failed to write response body to Sentinel: %w", err)
-		}
-	}
+// statusError is returned by fetchMDE for a response other than 200 OK.
+type statusError struct {
+	StatusCode int
+	Status     string
+}
 
-	return nil
+func (e *statusError) Error() string {
+	return "request failed with status code " + e.Status
 }
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GraphResource is the Microsoft Graph API, which needs its own access token.
+const GraphResource = "https://graph.microsoft.com"
+
+// GetGraphSecurityData retrieves the incidents or alerts of a Microsoft Graph
+// security endpoint updated since the checkpoint of table, or since from on
+// the first run, following the @odata.nextLink of every page. The checkpoint
+// moves to the latest lastUpdateDateTime once the records are delivered.
+func GetGraphSecurityData(cfg Config, endpoint string, queryParams string, table string, from time.Time) error {
+	since, err := loadCheckpoint(cfg, table, from)
+	if err != nil {
+		return err
+	}
+	log.Printf("Querying %s updated since %s\n", table, since.Format(time.RFC3339))
+
+	filter := "$filter=" + strings.ReplaceAll(url.QueryEscape("lastUpdateDateTime ge "+since.UTC().Format(time.RFC3339Nano)), "+", "%20")
+	next := GraphResource + endpoint + "?" + filter
+	if queryParams != "" {
+		next += "&" + queryParams
+	}
+
+	// fetchMDE sends cfg.AccessToken, which is swapped for the Graph token.
+	graphCfg := cfg
+	graphCfg.AccessToken = cfg.GraphToken
+
+	var records []Record
+	for next != "" {
+		body, err := fetchMDE(graphCfg, next)
+		if err != nil {
+			return err
+		}
+		page, err := DecodeRecords(body)
+		if err != nil {
+			return err
+		}
+		records = append(records, page...)
+
+		next = nextLink(body)
+		if next != "" {
+			log.Printf("Running, retrieved %d records\n", len(records))
+		}
+	}
+
+	latest := since
+	for _, record := range records {
+		if updated, ok := parseTime(fieldString(record, "lastUpdateDateTime")); ok && updated.After(latest) {
+			latest = updated
+		}
+	}
+
+	if err := deliver(cfg, table, strings.TrimPrefix(GraphResource, "https://")+endpoint, records); err != nil {
+		return err
+	}
+	return saveCheckpoint(cfg, table, latest)
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxAttempts is how often a sink request is tried before giving up.
+const maxAttempts = 4
+
+// retryable reports whether a response status is worth another attempt.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// doWithRetry sends the request built by newRequest, retrying network errors,
+// throttling and server errors with exponential backoff. Retry-After is
+// honoured when the server sends it. newRequest is called for every attempt so
+// the body can be replayed.
+func doWithRetry(client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+
+		resp, err := client.Do(req)
+		if err == nil && !retryable(resp.StatusCode) {
+			return resp, nil
+		}
+		if attempt == maxAttempts {
+			if err != nil {
+				return nil, fmt.Errorf("failed to send request: %w", err)
+			}
+			return resp, nil
+		}
+
+		wait := backoff
+		if err != nil {
+			log.Printf("Request to %s failed, retrying in %s: %v\n", req.URL.Host, wait, err)
+		} else {
+			if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			log.Printf("Request to %s returned %s, retrying in %s\n", req.URL.Host, resp.Status, wait)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,293 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// huntRowLimit is the most rows the advanced hunting API returns for a
+	// query. A window that hits it is split in two and queried again.
+	huntRowLimit = 100000
+	// huntMinWindow stops splitting windows that still hit the row limit.
+	huntMinWindow = time.Minute
+	// huntRetention is how far back advanced hunting data goes.
+	huntRetention = 30 * 24 * time.Hour
+	huntTimeout   = 10 * time.Minute
+)
+
+// HuntQuery is a KQL query read from a query file. The query can use the
+// HuntStart and HuntEnd datetimes, which are set to the window to search.
+type HuntQuery struct {
+	// Name is the file name without extension, and the table the results
+	// are sent to.
+	Name  string
+	Query string
+	// Schedule is the minimum time between runs, from a "// schedule: 1h"
+	// header. Zero runs the query every time.
+	Schedule time.Duration
+	// Lookback is the window of the first run, from a "// lookback: 7d"
+	// header. Later runs continue from the end of the previous window.
+	Lookback time.Duration
+}
+
+var (
+	huntHeader     = regexp.MustCompile(`^//\s*(schedule|lookback)\s*:\s*(\S+)\s*$`)
+	huntTableChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+	huntWindowVars = regexp.MustCompile(`\bHunt(Start|End)\b`)
+)
+
+// LoadHuntQueries reads the .kql files in dir.
+func LoadHuntQueries(dir string) ([]HuntQuery, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.kql"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .kql files found in %s", dir)
+	}
+	sort.Strings(files)
+
+	queries := make([]HuntQuery, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read query: %w", err)
+		}
+		query := HuntQuery{
+			Name:  huntTableName(strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))),
+			Query: strings.TrimSpace(string(data)),
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			match := huntHeader.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+			if match == nil {
+				continue
+			}
+			duration, err := parseHuntDuration(match[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s in %s: %w", match[1], file, err)
+			}
+			if match[1] == "schedule" {
+				query.Schedule = duration
+			} else {
+				query.Lookback = duration
+			}
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// huntTableName turns a query file name into a table name, prefixing names
+// that do not start with a letter or underscore, such as 01_lateral.
+func huntTableName(name string) string {
+	name = huntTableChars.ReplaceAllString(name, "_")
+	if name == "" || !(name[0] == '_' || name[0] >= 'A' && name[0] <= 'Z' || name[0] >= 'a' && name[0] <= 'z') {
+		name = "Hunt_" + name
+	}
+	return name
+}
+
+// parseHuntDuration parses a Go duration, with d for days added.
+func parseHuntDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// RunHunts runs the queries in dir against the advanced hunting endpoint at
+// location and delivers the results of each to a table named after its file.
+// Every query keeps a checkpoint, so the next run searches from where the
+// previous one ended; lookback is the first window of queries without a
+// lookback header.
+func RunHunts(cfg Config, endpoint string, location string, dir string, lookback time.Duration) error {
+	queries, err := LoadHuntQueries(dir)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://%s.securitycenter.windows.com%s", location, endpoint)
+	for _, query := range queries {
+		if err := runHunt(cfg, url, query, lookback); err != nil {
+			return fmt.Errorf("hunt %s failed: %w", query.Name, err)
+		}
+	}
+	return nil
+}
+
+func runHunt(cfg Config, url string, query HuntQuery, lookback time.Duration) error {
+	end := cfg.HarvestTime.UTC()
+	if end.IsZero() {
+		end = time.Now().UTC()
+	}
+	if query.Lookback > 0 {
+		lookback = query.Lookback
+	}
+
+	name := "hunt-" + query.Name
+	start, err := loadCheckpoint(cfg, name, time.Time{})
+	if err != nil {
+		return err
+	}
+	// The schedule counts from the previous run; the first run is never
+	// skipped, even when the schedule is longer than the lookback.
+	switch {
+	case start.IsZero():
+		start = end.Add(-lookback)
+	case query.Schedule > 0 && end.Sub(start) < query.Schedule:
+		log.Printf("Skipping hunt %s, next run due at %s\n", query.Name, start.Add(query.Schedule).Format(time.RFC3339))
+		return nil
+	}
+	if oldest := end.Add(-huntRetention); start.Before(oldest) {
+		start = oldest
+	}
+
+	log.Printf("Running hunt %s from %s to %s\n", query.Name, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	records, err := huntWindow(cfg, url, query, start, end)
+	if err != nil {
+		return err
+	}
+	log.Printf("Hunt %s returned %d rows\n", query.Name, len(records))
+
+	if err := deliver(cfg, query.Name, strings.TrimPrefix(url, "https://"), records); err != nil {
+		return err
+	}
+	return saveCheckpoint(cfg, name, end)
+}
+
+// huntWindow runs query over [start, end), splitting the window in halves
+// while a query returns the maximum number of rows. Only queries that use
+// HuntStart or HuntEnd are split.
+func huntWindow(cfg Config, url string, query HuntQuery, start time.Time, end time.Time) ([]Record, error) {
+	records, err := runHuntQuery(cfg, url, huntKQL(query.Query, start, end))
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < huntRowLimit {
+		return records, nil
+	}
+	if end.Sub(start) <= huntMinWindow {
+		log.Printf("Hunt %s returned %d rows for %s, results may be truncated\n", query.Name, len(records), start.Format(time.RFC3339))
+		return records, nil
+	}
+	// A query that ignores the window returns the same rows for every half,
+	// so splitting would only repeat it until the minimum window.
+	if !huntWindowVars.MatchString(query.Query) {
+		log.Printf("Hunt %s returned %d rows and does not filter on HuntStart or HuntEnd, results may be truncated\n", query.Name, len(records))
+		return records, nil
+	}
+
+	middle := start.Add(end.Sub(start) / 2).Truncate(time.Second)
+	log.Printf("Hunt %s hit the row limit, splitting the window at %s\n", query.Name, middle.Format(time.RFC3339))
+	first, err := huntWindow(cfg, url, query, start, middle)
+	if err != nil {
+		return nil, err
+	}
+	second, err := huntWindow(cfg, url, query, middle, end)
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// huntKQL prepends the HuntStart and HuntEnd declarations to query.
+func huntKQL(query string, start time.Time, end time.Time) string {
+	return fmt.Sprintf("let HuntStart = datetime(%s);\nlet HuntEnd = datetime(%s);\n%s",
+		start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano), query)
+}
+
+// huntResponse is the advanced hunting API result.
+type huntResponse struct {
+	Schema []struct {
+		Name string `json:"Name"`
+		Type string `json:"Type"`
+	} `json:"Schema"`
+	Results []Record `json:"Results"`
+}
+
+// runHuntQuery posts a query and returns its rows, typed through the schema:
+// every column is present, and dynamic columns returned as JSON text are
+// decoded.
+func runHuntQuery(cfg Config, url string, kql string) ([]Record, error) {
+	requestBody, err := json.Marshal(map[string]string{"Query": kql})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Debug {
+		log.Printf("Running query:\n%s\n", kql)
+	}
+
+	client := &http.Client{Timeout: huntTimeout}
+	resp, err := doWithRetry(client, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(requestBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+cfg.AccessToken)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("request failed with status code %s: %s", resp.Status, body)
+	}
+
+	var result huntResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	for _, record := range result.Results {
+		for _, column := range result.Schema {
+			value, ok := record[column.Name]
+			if !ok {
+				record[column.Name] = nil
+				continue
+			}
+			text, isString := value.(string)
+			if !isString {
+				continue
+			}
+			switch strings.ToLower(column.Type) {
+			case "object", "dynamic":
+				var decoded interface{}
+				if err := json.Unmarshal([]byte(text), &decoded); err == nil {
+					record[column.Name] = decoded
+				}
+			case "datetime":
+				if t, ok := parseTime(text); ok {
+					record[column.Name] = t.UTC().Format(time.RFC3339Nano)
+				}
+			}
+		}
+	}
+	return result.Results, nil
+}
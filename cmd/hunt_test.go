@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHuntTableName(t *testing.T) {
+	tests := map[string]string{
+		"LiveResponseLogons": "LiveResponseLogons",
+		"_private":           "_private",
+		"01_lateral":         "Hunt_01_lateral",
+		"lateral movement":   "lateral_movement",
+		"rdp-logons.v2":      "rdp_logons_v2",
+		"2024-q1":            "Hunt_2024_q1",
+	}
+	for name, want := range tests {
+		if got := huntTableName(name); got != want {
+			t.Errorf("huntTableName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func writeQueries(t *testing.T, queries map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, query := range queries {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(query), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadHuntQueries(t *testing.T) {
+	dir := writeQueries(t, map[string]string{
+		"01_lateral.kql": "// schedule: 1h\n//lookback:7d\nDeviceLogonEvents\n| where Timestamp >= HuntStart\n",
+		"Plain.kql":      "DeviceEvents | take 10",
+		"notes.txt":      "// schedule: 5m",
+	})
+	queries, err := LoadHuntQueries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 {
+		t.Fatalf("loaded %d queries, want the 2 .kql files", len(queries))
+	}
+
+	lateral := queries[0]
+	if lateral.Name != "Hunt_01_lateral" || lateral.Schedule != time.Hour || lateral.Lookback != 7*24*time.Hour {
+		t.Errorf("query %+v", lateral)
+	}
+	if !strings.HasPrefix(lateral.Query, "// schedule: 1h") || strings.HasSuffix(lateral.Query, "\n") {
+		t.Errorf("query text %q, want the trimmed file", lateral.Query)
+	}
+	if plain := queries[1]; plain.Name != "Plain" || plain.Schedule != 0 || plain.Lookback != 0 {
+		t.Errorf("query %+v", plain)
+	}
+
+	for _, header := range []string{"// schedule: often", "// lookback: xd"} {
+		dir := writeQueries(t, map[string]string{"Bad.kql": header + "\nDeviceEvents"})
+		if _, err := LoadHuntQueries(dir); err == nil {
+			t.Errorf("header %q was accepted", header)
+		}
+	}
+	if _, err := LoadHuntQueries(t.TempDir()); err == nil {
+		t.Error("a directory without queries was accepted")
+	}
+}
+
+var huntWindowDecl = regexp.MustCompile(`let HuntStart = datetime\((.*)\);\nlet HuntEnd = datetime\((.*)\);\n`)
+
+// huntWindowOf returns the window declared in front of a query.
+func huntWindowOf(t *testing.T, r *http.Request) (time.Time, time.Time) {
+	t.Helper()
+	var body struct{ Query string }
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	match := huntWindowDecl.FindStringSubmatch(body.Query)
+	if match == nil {
+		t.Fatalf("query %q does not declare the window", body.Query)
+	}
+	start, _ := time.Parse(time.RFC3339Nano, match[1])
+	end, _ := time.Parse(time.RFC3339Nano, match[2])
+	return start, end
+}
+
+type huntWindowRange struct{ start, end time.Time }
+
+// newHuntServer answers every query with rows(window) rows and returns the
+// windows it was asked for.
+func newHuntServer(t *testing.T, rows func(start, end time.Time) int) (string, *[]huntWindowRange) {
+	t.Helper()
+	var windows []huntWindowRange
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, end := huntWindowOf(t, r)
+		windows = append(windows, huntWindowRange{start, end})
+		results := make([]Record, rows(start, end))
+		for i := range results {
+			results[i] = Record{"n": i}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Results": results})
+	}))
+	t.Cleanup(s.Close)
+	return s.URL, &windows
+}
+
+func TestRunHuntSchedule(t *testing.T) {
+	url, windows := newHuntServer(t, func(start, end time.Time) int { return 1 })
+	state, err := NewStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	cfg := Config{
+		HarvestTime: first,
+		State:       state,
+		Files:       true,
+		FileOptions: FileOptions{Dir: t.TempDir(), Name: "{table}"},
+	}
+	query := HuntQuery{Name: "Logons", Query: "DeviceLogonEvents", Schedule: time.Hour, Lookback: 2 * time.Hour}
+
+	runs := []struct {
+		at   time.Time
+		want *huntWindowRange
+	}{
+		{at: first, want: &huntWindowRange{first.Add(-2 * time.Hour), first}},
+		{at: first.Add(30 * time.Minute)},
+		{at: first.Add(time.Hour), want: &huntWindowRange{first, first.Add(time.Hour)}},
+	}
+	for _, run := range runs {
+		*windows = nil
+		cfg.HarvestTime = run.at
+		if err := runHunt(cfg, url, query, 24*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case run.want == nil && len(*windows) != 0:
+			t.Errorf("run at %s was not skipped: %v", run.at, *windows)
+		case run.want != nil && (len(*windows) != 1 || (*windows)[0] != *run.want):
+			t.Errorf("run at %s queried %v, want %v", run.at, *windows, *run.want)
+		}
+	}
+
+	// The checkpoint is capped at the advanced hunting retention.
+	*windows = nil
+	cfg.HarvestTime = first.Add(60 * 24 * time.Hour)
+	if err := runHunt(cfg, url, query, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(*windows) != 1 || (*windows)[0].start != cfg.HarvestTime.Add(-huntRetention) {
+		t.Errorf("queried %v, want the window to start at the retention", *windows)
+	}
+}
+
+func TestHuntWindowSplits(t *testing.T) {
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	end := start.Add(4 * time.Hour)
+	url, windows := newHuntServer(t, func(start, end time.Time) int {
+		if end.Sub(start) > time.Hour {
+			return huntRowLimit
+		}
+		return 1
+	})
+
+	query := HuntQuery{Name: "Logons", Query: "DeviceLogonEvents | where Timestamp between (HuntStart .. HuntEnd)"}
+	records, err := huntWindow(Config{}, url, query, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 4h hits the limit, both 2h halves do too, the four 1h quarters do not.
+	if len(*windows) != 7 || len(records) != 4 {
+		t.Errorf("%d queries returned %d rows, want 7 queries and 4 rows", len(*windows), len(records))
+	}
+	var covered time.Duration
+	for _, window := range *windows {
+		if window.end.Sub(window.start) == time.Hour {
+			covered += time.Hour
+		}
+	}
+	if covered != end.Sub(start) {
+		t.Errorf("the smallest windows cover %s, want %s", covered, end.Sub(start))
+	}
+}
+
+func TestHuntWindowWithoutWindowFilter(t *testing.T) {
+	url, windows := newHuntServer(t, func(start, end time.Time) int { return huntRowLimit })
+
+	query := HuntQuery{Name: "Everything", Query: "DeviceEvents | where Timestamp > ago(1d)"}
+	start := time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC)
+	records, err := huntWindow(Config{}, url, query, start, start.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*windows) != 1 || len(records) != huntRowLimit {
+		t.Errorf("%d queries returned %d rows, want the query run once", len(*windows), len(records))
+	}
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// kafkaTimeout bounds how long a table waits for its delivery reports.
+const kafkaTimeout = 2 * time.Minute
+
+// SendToKafka publishes each record as a message to the topic named after the
+// table. The producer is idempotent and waits for all in-sync replicas, and
+// an error is returned unless every message was acknowledged, so records are
+// only marked as delivered once the brokers have them.
+func SendToKafka(records []Record, table string) error {
+	brokers := os.Getenv("KafkaBrokers")
+	if brokers == "" {
+		return fmt.Errorf("KafkaBrokers is not set")
+	}
+	topic := os.Getenv("KafkaTopicPrefix") + table
+	keyField := os.Getenv("KafkaKeyField")
+	if keyField == "" {
+		keyField = "RecordId"
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(strings.Split(brokers, ",")...),
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.ProducerBatchCompression(kgo.ZstdCompression(), kgo.SnappyCompression()),
+		kgo.ProduceRequestTimeout(30 * time.Second),
+	}
+	if os.Getenv("KafkaAutoCreateTopics") == "true" {
+		opts = append(opts, kgo.AllowAutoTopicCreation())
+	}
+	if os.Getenv("KafkaTLS") == "true" {
+		opts = append(opts, kgo.DialTLSConfig(&tls.Config{
+			InsecureSkipVerify: os.Getenv("KafkaInsecure") == "true",
+		}))
+	}
+
+	username, password := os.Getenv("KafkaUsername"), os.Getenv("KafkaPassword")
+	switch mechanism := strings.ToUpper(os.Getenv("KafkaSaslMechanism")); mechanism {
+	case "":
+	case "PLAIN":
+		opts = append(opts, kgo.SASL(plain.Auth{User: username, Pass: password}.AsMechanism()))
+	case "SCRAM-SHA-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: username, Pass: password}.AsSha256Mechanism()))
+	case "SCRAM-SHA-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: username, Pass: password}.AsSha512Mechanism()))
+	default:
+		return fmt.Errorf("unsupported KafkaSaslMechanism %s", mechanism)
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+	defer client.Close()
+
+	messages := make([]*kgo.Record, 0, len(records))
+	for _, record := range records {
+		value, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		message := &kgo.Record{
+			Topic:   topic,
+			Value:   value,
+			Headers: []kgo.RecordHeader{{Key: "table", Value: []byte(table)}},
+		}
+		if key := kafkaKey(record, keyField); key != "" {
+			message.Key = []byte(key)
+		}
+		messages = append(messages, message)
+	}
+
+	log.Println("↳ Sending data to Kafka topic:", topic)
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeout)
+	defer cancel()
+
+	var failed int
+	var firstErr error
+	for _, result := range client.ProduceSync(ctx, messages...) {
+		if result.Err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = result.Err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d messages were not delivered to %s: %w", failed, len(messages), topic, firstErr)
+	}
+	return nil
+}
+
+// kafkaKey returns the message key: the configured field, falling back to the
+// MachineId and the RecordId.
+func kafkaKey(record Record, keyField string) string {
+	for _, field := range []string{keyField, "MachineId", "RecordId"} {
+		if value, ok := record[field]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
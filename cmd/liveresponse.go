@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// LiveResponseTable holds one record per command run in a Live Response session.
+const LiveResponseTable = "MdeLiveResponseCommands"
+
+// liveResponseColumns declares the command records for provisioning.
+var liveResponseColumns = []SchemaColumn{
+	{Name: "ParentActionId", Type: "string"},
+	{Name: "MachineId", Type: "string"},
+	{Name: "ComputerDnsName", Type: "string"},
+	{Name: "Requestor", Type: "string"},
+	{Name: "RequestorComment", Type: "string"},
+	{Name: "ActionStatus", Type: "string"},
+	{Name: "CommandIndex", Type: "int"},
+	{Name: "CommandType", Type: "string"},
+	{Name: "CommandParams", Type: "dynamic"},
+	{Name: "CommandLine", Type: "string"},
+	{Name: "CommandStatus", Type: "string"},
+	{Name: "Errors", Type: "dynamic"},
+	{Name: "StartTime", Type: "datetime"},
+	{Name: "EndTime", Type: "datetime"},
+}
+
+// liveResponseAction is a LiveResponse machine action with its command history.
+type liveResponseAction struct {
+	ID               string `json:"id"`
+	Type             string `json:"type"`
+	Status           string `json:"status"`
+	Requestor        string `json:"requestor"`
+	RequestorComment string `json:"requestorComment"`
+	MachineID        string `json:"machineId"`
+	ComputerDNSName  string `json:"computerDnsName"`
+	Commands         []struct {
+		Index         int      `json:"index"`
+		StartTime     *string  `json:"startTime"`
+		EndTime       *string  `json:"endTime"`
+		CommandStatus string   `json:"commandStatus"`
+		Errors        []string `json:"errors"`
+		Command       struct {
+			Type   string `json:"type"`
+			Params []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"params"`
+		} `json:"command"`
+	} `json:"commands"`
+}
+
+// GetLiveResponseCommands retrieves the LiveResponse machine actions returned
+// by endpoint, following its @odata.nextLink, and delivers one record per
+// command (run, getfile, putfile, remediate, ...) linked to its action through
+// ParentActionId. The command history is taken from the listed action, and
+// only retrieved per action when the list does not include it.
+func GetLiveResponseCommands(cfg Config, endpoint string, queryParams string, table string, location string) error {
+	resource := fmt.Sprintf("https://%s.securitycenter.windows.com", location)
+
+	actions, err := fetchMDEPages(cfg, resource+endpoint+queryParams)
+	if err != nil {
+		return err
+	}
+
+	var records []Record
+	for _, summary := range actions {
+		id := fieldString(summary, "id")
+		if id == "" || !strings.EqualFold(fieldString(summary, "type"), "LiveResponse") {
+			continue
+		}
+
+		body, err := json.Marshal(summary)
+		if err != nil {
+			return fmt.Errorf("failed to encode Live Response action %s: %w", id, err)
+		}
+		if summary["commands"] == nil {
+			if body, err = fetchMDE(cfg, resource+"/api/machineactions/"+url.PathEscape(id)); err != nil {
+				return fmt.Errorf("failed to retrieve Live Response action %s: %w", id, err)
+			}
+		}
+		var action liveResponseAction
+		if err := json.Unmarshal(body, &action); err != nil {
+			return fmt.Errorf("failed to decode Live Response action %s: %w", id, err)
+		}
+		records = append(records, liveResponseRecords(action)...)
+	}
+	log.Printf("Retrieved %d Live Response commands\n", len(records))
+
+	return deliver(cfg, table, location+".securitycenter.windows.com"+endpoint, records)
+}
+
+// liveResponseRecords turns the command history of an action into records.
+func liveResponseRecords(action liveResponseAction) []Record {
+	records := make([]Record, 0, len(action.Commands))
+	for _, command := range action.Commands {
+		params := make(map[string]interface{}, len(command.Command.Params))
+		commandLine := []string{command.Command.Type}
+		for _, param := range command.Command.Params {
+			params[param.Key] = param.Value
+			commandLine = append(commandLine, "-"+param.Key, param.Value)
+		}
+
+		record := Record{
+			"ParentActionId":   action.ID,
+			"MachineId":        action.MachineID,
+			"ComputerDnsName":  action.ComputerDNSName,
+			"Requestor":        action.Requestor,
+			"RequestorComment": action.RequestorComment,
+			"ActionStatus":     action.Status,
+			"CommandIndex":     command.Index,
+			"CommandType":      command.Command.Type,
+			"CommandParams":    params,
+			"CommandLine":      strings.Join(commandLine, " "),
+			"CommandStatus":    command.CommandStatus,
+			"Errors":           command.Errors,
+		}
+		if command.StartTime != nil {
+			record["StartTime"] = *command.StartTime
+		}
+		if command.EndTime != nil {
+			record["EndTime"] = *command.EndTime
+		}
+		records = append(records, record)
+	}
+	return records
+}
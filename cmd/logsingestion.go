@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+const (
+	logsIngestionAPIVersion = "2023-01-01"
+	// logsIngestionMaxBytes is the payload limit of a Logs Ingestion API call.
+	logsIngestionMaxBytes = 1 << 20
+	monitorScope          = "https://monitor.azure.com/.default"
+)
+
+var (
+	monitorCredentialOnce sync.Once
+	monitorCredential     *azidentity.DefaultAzureCredential
+	monitorCredentialErr  error
+)
+
+// monitorToken returns an Entra ID token for the Logs Ingestion API. The
+// credential is shared between calls, so its token cache is reused.
+var monitorToken = func(ctx context.Context) (string, error) {
+	monitorCredentialOnce.Do(func() {
+		monitorCredential, monitorCredentialErr = azidentity.NewDefaultAzureCredential(nil)
+	})
+	if monitorCredentialErr != nil {
+		return "", fmt.Errorf("failed to create credential: %w", monitorCredentialErr)
+	}
+	token, err := monitorCredential.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{monitorScope}})
+	if err != nil {
+		return "", fmt.Errorf("failed to get token: %w", err)
+	}
+	return token.Token, nil
+}
+
+// LogsIngestionEnabled reports whether -sentinel sends through the Logs
+// Ingestion API, which is the case once SentinelDceUri is set.
+func LogsIngestionEnabled() bool {
+	return os.Getenv("SentinelDceUri") != ""
+}
+
+// logsIngestionStream is the data collection rule stream of table, which
+// provision declares for the <table>_CL custom table.
+func logsIngestionStream(table string) string {
+	return "Custom-" + table + "_CL"
+}
+
+// logsIngestionRule returns the immutable id of the data collection rule of
+// table: SentinelDcrImmutableId_<table> when set, otherwise
+// SentinelDcrImmutableId for a rule holding the streams of all tables.
+func logsIngestionRule(table string) string {
+	for _, name := range []string{"SentinelDcrImmutableId_" + table, "SentinelDcrImmutableId"} {
+		if id := os.Getenv(name); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// SendToLogsIngestion posts records to the stream of table through the data
+// collection endpoint in SentinelDceUri, authenticated with an Entra ID
+// token. The data collection rule and custom table are the ones written by
+// the provision command. Records are sent in batches below the 1 MB limit;
+// larger records are skipped.
+func SendToLogsIngestion(records []Record, table string) error {
+	dceUri := strings.TrimRight(os.Getenv("SentinelDceUri"), "/")
+	rule := logsIngestionRule(table)
+	if rule == "" {
+		return fmt.Errorf("set SentinelDcrImmutableId_%s or SentinelDcrImmutableId", table)
+	}
+	endpoint := fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=%s",
+		dceUri, url.PathEscape(rule), url.PathEscape(logsIngestionStream(table)), logsIngestionAPIVersion)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	token, err := monitorToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	batches, err := logsIngestionBatches(records)
+	if err != nil {
+		return err
+	}
+	log.Println("↳ Sending data to Sentinel stream:", logsIngestionStream(table))
+	client := &http.Client{Timeout: 60 * time.Second}
+	for _, body := range batches {
+		resp, err := doWithRetry(client, func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", "application/json")
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status from the Logs Ingestion API: %s: %s", resp.Status, respBody)
+		}
+	}
+	return nil
+}
+
+// logsIngestionBatches encodes records as JSON arrays of at most
+// logsIngestionMaxBytes. A record that does not fit in a call on its own is
+// skipped, so it does not hold back the rest of the table.
+func logsIngestionBatches(records []Record) ([][]byte, error) {
+	var batches [][]byte
+	var batch bytes.Buffer
+	skipped := 0
+	for _, record := range records {
+		doc, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		if len(doc)+2 > logsIngestionMaxBytes {
+			if skipped == 0 {
+				log.Printf("Skipping record %v, it is larger than the %d byte Logs Ingestion API limit\n", record["RecordId"], logsIngestionMaxBytes)
+			}
+			skipped++
+			continue
+		}
+		if batch.Len() > 0 && batch.Len()+len(doc)+2 > logsIngestionMaxBytes {
+			batch.WriteByte(']')
+			batches = append(batches, append([]byte(nil), batch.Bytes()...))
+			batch.Reset()
+		}
+		if batch.Len() == 0 {
+			batch.WriteByte('[')
+		} else {
+			batch.WriteByte(',')
+		}
+		batch.Write(doc)
+	}
+	if batch.Len() > 0 {
+		batch.WriteByte(']')
+		batches = append(batches, batch.Bytes())
+	}
+	if skipped > 1 {
+		log.Printf("Skipped %d records larger than the Logs Ingestion API limit\n", skipped)
+	}
+	return batches, nil
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogsIngestionBatches(t *testing.T) {
+	pad := strings.Repeat("x", 300*1024)
+	records := []Record{
+		{"RecordId": "1", "pad": pad},
+		{"RecordId": "2", "pad": pad},
+		{"RecordId": "3", "pad": pad},
+		{"RecordId": "too large", "pad": pad + pad + pad + pad},
+		{"RecordId": "4", "pad": pad},
+		{"RecordId": "5"},
+	}
+	batches, err := logsIngestionBatches(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids [][]string
+	for _, batch := range batches {
+		if len(batch) > logsIngestionMaxBytes {
+			t.Errorf("batch of %d bytes is over the limit", len(batch))
+		}
+		var decoded []Record
+		if err := json.Unmarshal(batch, &decoded); err != nil {
+			t.Fatalf("batch is not a JSON array: %v", err)
+		}
+		var batchIDs []string
+		for _, record := range decoded {
+			batchIDs = append(batchIDs, record["RecordId"].(string))
+		}
+		ids = append(ids, batchIDs)
+	}
+	want := [][]string{{"1", "2", "3"}, {"4", "5"}}
+	if len(ids) != len(want) || !equalStrings(ids[0], want[0]) || !equalStrings(ids[1], want[1]) {
+		t.Errorf("batches %v, want %v without the oversized record", ids, want)
+	}
+
+	if batches, err := logsIngestionBatches(nil); err != nil || len(batches) != 0 {
+		t.Errorf("no records gave %d batches, %v", len(batches), err)
+	}
+}
+
+func TestLogsIngestionRule(t *testing.T) {
+	t.Setenv("SentinelDcrImmutableId", "")
+	t.Setenv("SentinelDcrImmutableId_MdeTimeline", "")
+	if rule := logsIngestionRule("MdeTimeline"); rule != "" {
+		t.Errorf("rule %q without configuration", rule)
+	}
+
+	t.Setenv("SentinelDcrImmutableId", "dcr-all")
+	t.Setenv("SentinelDcrImmutableId_MdeTimeline", "dcr-timeline")
+	if rule := logsIngestionRule("MdeTimeline"); rule != "dcr-timeline" {
+		t.Errorf("rule %q, want the per-table rule", rule)
+	}
+	if rule := logsIngestionRule("MdeRoles"); rule != "dcr-all" {
+		t.Errorf("rule %q, want the shared rule", rule)
+	}
+}
+
+// stubMonitorToken replaces the Entra ID token for the test.
+func stubMonitorToken(t *testing.T, token string, err error) {
+	t.Helper()
+	original := monitorToken
+	monitorToken = func(ctx context.Context) (string, error) { return token, err }
+	t.Cleanup(func() { monitorToken = original })
+}
+
+func TestSendToLogsIngestion(t *testing.T) {
+	var requests []*http.Request
+	var bodies []string
+	status := http.StatusNoContent
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+	stubMonitorToken(t, "token", nil)
+	t.Setenv("SentinelDceUri", s.URL+"/")
+	t.Setenv("SentinelDcrImmutableId", "")
+	t.Setenv("SentinelDcrImmutableId_MdeTimeline", "dcr-1")
+
+	if err := SendToLogsIngestion([]Record{{"RecordId": "1"}}, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	if req.Method != http.MethodPost || req.URL.Path != "/dataCollectionRules/dcr-1/streams/Custom-MdeTimeline_CL" || req.URL.Query().Get("api-version") != logsIngestionAPIVersion {
+		t.Errorf("request %s %s", req.Method, req.URL)
+	}
+	if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("headers %v", req.Header)
+	}
+	if bodies[0] != `[{"RecordId":"1"}]` {
+		t.Errorf("body %s", bodies[0])
+	}
+
+	status = http.StatusForbidden
+	if err := SendToLogsIngestion([]Record{{"RecordId": "1"}}, "MdeTimeline"); err == nil {
+		t.Error("a rejected batch did not fail the send")
+	}
+	if err := SendToLogsIngestion([]Record{{"RecordId": "1"}}, "MdeRoles"); err == nil {
+		t.Error("a table without a rule was accepted")
+	}
+	stubMonitorToken(t, "", errors.New("no credential"))
+	if err := SendToLogsIngestion([]Record{{"RecordId": "1"}}, "MdeTimeline"); err == nil {
+		t.Error("a token failure did not fail the send")
+	}
+}
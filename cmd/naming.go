@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"strings"
+	"time"
+)
+
+// expandName fills the placeholders of a sink naming pattern:
+// {table}, {date} (2006.01.02), {day} (2006-01-02) and {hour} (15).
+func expandName(pattern string, table string, t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer(
+		"{table}", table,
+		"{date}", t.Format("2006.01.02"),
+		"{day}", t.Format("2006-01-02"),
+		"{hour}", t.Format("15"),
+	).Replace(pattern)
+}
+
+// recordTimeGenerated returns the TimeGenerated set by Enrich, or now.
+func recordTimeGenerated(record Record) time.Time {
+	if value, ok := record["TimeGenerated"].(string); ok {
+		if t, ok := parseTime(value); ok {
+			return t
+		}
+	}
+	return time.Now().UTC()
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// objectStoreTimeout bounds how long a table may take to be uploaded.
+const objectStoreTimeout = 5 * time.Minute
+
+// iamTimeout bounds the requests to the instance metadata service for IAM
+// role credentials.
+const iamTimeout = 10 * time.Second
+
+const defaultObjectKey = "table={table}/date={day}/hour={hour}/"
+
+// objectUploader stores one object under key.
+type objectUploader func(ctx context.Context, key string, data []byte) error
+
+// SendToObjectStore archives records as gzipped NDJSON objects in S3
+// compatible storage or Azure Blob storage, depending on ObjectStoreType.
+// Records are partitioned by the hour of their TimeGenerated, using Hive
+// style keys like table=MdeTimeline/date=2026-10-18/hour=13/.
+func SendToObjectStore(records []Record, table string) error {
+	var upload objectUploader
+	var err error
+	switch storeType := strings.ToLower(os.Getenv("ObjectStoreType")); storeType {
+	case "s3":
+		upload, err = newS3Uploader()
+	case "azblob":
+		upload, err = newAzureBlobUploader()
+	default:
+		return fmt.Errorf("unsupported ObjectStoreType %q, use s3 or azblob", storeType)
+	}
+	if err != nil {
+		return err
+	}
+
+	keyPattern := os.Getenv("ObjectStorePrefix") + defaultObjectKey
+	partitions := make(map[string][]Record)
+	for _, record := range records {
+		prefix := expandName(keyPattern, table, recordTimeGenerated(record))
+		partitions[prefix] = append(partitions[prefix], record)
+	}
+	prefixes := make([]string, 0, len(partitions))
+	for prefix := range partitions {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), objectStoreTimeout)
+	defer cancel()
+
+	log.Println("↳ Archiving data to object storage for table:", table)
+	for _, prefix := range prefixes {
+		data, err := gzipNDJSON(partitions[prefix])
+		if err != nil {
+			return err
+		}
+		key := prefix + objectName()
+		if err := upload(ctx, key, data); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", key, err)
+		}
+		log.Printf("Wrote %d events to %s\n", len(partitions[prefix]), key)
+	}
+	return nil
+}
+
+// objectName returns a unique name for an object written by this run.
+func objectName() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("part-%s-%s.ndjson.gz", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+}
+
+func gzipNDJSON(records []Record) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(zw)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, fmt.Errorf("failed to encode record: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress records: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func newS3Uploader() (objectUploader, error) {
+	endpoint, bucket := os.Getenv("S3Endpoint"), os.Getenv("S3Bucket")
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("S3Endpoint and S3Bucket must be set")
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.Static{Value: credentials.Value{
+			AccessKeyID:     os.Getenv("S3AccessKey"),
+			SecretAccessKey: os.Getenv("S3SecretKey"),
+			SignerType:      credentials.SignatureV4,
+		}},
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{},
+		// The IAM provider has no default HTTP client and panics without one.
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport, Timeout: iamTimeout}},
+	})
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: os.Getenv("S3UseSSL") != "false",
+		Region: os.Getenv("S3Region"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	// The objects are stored as gzip files rather than with a gzip content
+	// encoding, which clients would decompress silently on download.
+	options := minio.PutObjectOptions{ContentType: "application/gzip"}
+	switch sse := os.Getenv("S3ServerSideEncryption"); sse {
+	case "":
+	case "AES256":
+		options.ServerSideEncryption = encrypt.NewSSE()
+	case "aws:kms":
+		options.ServerSideEncryption, err = encrypt.NewSSEKMS(os.Getenv("S3KmsKeyId"), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure KMS encryption: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported S3ServerSideEncryption %q, use AES256 or aws:kms", sse)
+	}
+
+	return func(ctx context.Context, key string, data []byte) error {
+		_, err := client.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)), options)
+		return err
+	}, nil
+}
+
+func newAzureBlobUploader() (objectUploader, error) {
+	container := os.Getenv("AzureBlobContainer")
+	if container == "" {
+		return nil, fmt.Errorf("AzureBlobContainer must be set")
+	}
+
+	var client *azblob.Client
+	var err error
+	if connectionString := os.Getenv("AzureBlobConnectionString"); connectionString != "" {
+		client, err = azblob.NewClientFromConnectionString(connectionString, nil)
+	} else {
+		accountUrl := os.Getenv("AzureBlobAccountUrl")
+		if accountUrl == "" {
+			return nil, fmt.Errorf("set AzureBlobConnectionString or AzureBlobAccountUrl")
+		}
+		credential, credErr := azidentity.NewDefaultAzureCredential(nil)
+		if credErr != nil {
+			return nil, fmt.Errorf("failed to create credential: %w", credErr)
+		}
+		client, err = azblob.NewClient(accountUrl, credential, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+	}
+
+	options := &azblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{
+			BlobContentType: stringPtr("application/gzip"),
+		},
+	}
+	if scope := os.Getenv("AzureBlobEncryptionScope"); scope != "" {
+		options.CPKScopeInfo = &blob.CPKScopeInfo{EncryptionScope: &scope}
+	}
+
+	return func(ctx context.Context, key string, data []byte) error {
+		_, err := client.UploadBuffer(ctx, container, key, data, options)
+		return err
+	}, nil
+}
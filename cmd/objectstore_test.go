@@ -0,0 +1,290 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// objectStoreEnvVars are cleared for every test, so the environment running
+// the tests does not change the results.
+var objectStoreEnvVars = []string{
+	"ObjectStorePrefix", "S3AccessKey", "S3SecretKey", "S3ServerSideEncryption", "S3KmsKeyId",
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"AzureBlobConnectionString", "AzureBlobAccountUrl", "AzureBlobEncryptionScope",
+}
+
+// storedObject is an object PUT to the stand-in object store.
+type storedObject struct {
+	Path    string
+	Header  http.Header
+	Records []Record
+}
+
+// objectServer is a stand-in S3 or Azure Blob service recording the objects
+// uploaded to it.
+type objectServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects []storedObject
+}
+
+func newObjectServer(t *testing.T, env map[string]string, status int) *objectServer {
+	t.Helper()
+	for _, name := range objectStoreEnvVars {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	s := &objectServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		object := storedObject{Path: r.URL.Path, Header: r.Header.Clone()}
+		body, err := objectBody(r)
+		if err != nil {
+			t.Errorf("object %s: %v", r.URL.Path, err)
+			return
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Errorf("object %s is not gzipped: %v", r.URL.Path, err)
+			return
+		}
+		scanner := bufio.NewScanner(zr)
+		for scanner.Scan() {
+			var record Record
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Errorf("object %s holds an invalid NDJSON line: %v", r.URL.Path, err)
+			}
+			object.Records = append(object.Records, record)
+		}
+		s.mu.Lock()
+		s.objects = append(s.objects, object)
+		s.mu.Unlock()
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// objectBody returns the body of an upload, decoding the aws-chunked
+// encoding minio-go signs streamed uploads with over plain HTTP.
+func objectBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var body []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked body: %w", err)
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked chunk size: %w", err)
+		}
+		if size == 0 {
+			return body, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, fmt.Errorf("invalid aws-chunked chunk: %w", err)
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+// sortedObjects returns the stored objects ordered by path.
+func (s *objectServer) sortedObjects() []storedObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := append([]storedObject(nil), s.objects...)
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Path < objects[j].Path })
+	return objects
+}
+
+func archiveRecords() []Record {
+	return []Record{
+		{"RecordId": "a", "TimeGenerated": "2026-10-18T13:05:00Z"},
+		{"RecordId": "b", "TimeGenerated": "2026-10-18T13:55:00Z"},
+		{"RecordId": "c", "TimeGenerated": "2026-10-18T14:00:00Z"},
+	}
+}
+
+var objectNamePattern = regexp.MustCompile(`^part-\d{8}T\d{6}Z-[0-9a-f]{8}\.ndjson\.gz$`)
+
+// checkArchive verifies that records were stored per hour under prefix.
+func checkArchive(t *testing.T, objects []storedObject, prefix string) {
+	t.Helper()
+	if len(objects) != 2 {
+		t.Fatalf("stored %d objects, want one per hour", len(objects))
+	}
+	want := []struct {
+		dir string
+		ids []string
+	}{
+		{prefix + "table=MdeTimeline/date=2026-10-18/hour=13/", []string{"a", "b"}},
+		{prefix + "table=MdeTimeline/date=2026-10-18/hour=14/", []string{"c"}},
+	}
+	for i, object := range objects {
+		dir, name := object.Path[:strings.LastIndex(object.Path, "/")+1], object.Path[strings.LastIndex(object.Path, "/")+1:]
+		if dir != want[i].dir || !objectNamePattern.MatchString(name) {
+			t.Errorf("object stored at %s, want %spart-<time>-<suffix>.ndjson.gz", object.Path, want[i].dir)
+		}
+		var ids []string
+		for _, record := range object.Records {
+			ids = append(ids, record["RecordId"].(string))
+		}
+		if strings.Join(ids, ",") != strings.Join(want[i].ids, ",") {
+			t.Errorf("object %s holds records %v, want %v", object.Path, ids, want[i].ids)
+		}
+	}
+}
+
+func TestObjectStoreS3(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		headers map[string]string
+	}{
+		{
+			name: "no encryption",
+			headers: map[string]string{
+				"Content-Type":                 "application/gzip",
+				"X-Amz-Server-Side-Encryption": "",
+			},
+		},
+		{
+			name:    "AES256",
+			env:     map[string]string{"S3ServerSideEncryption": "AES256"},
+			headers: map[string]string{"X-Amz-Server-Side-Encryption": "AES256"},
+		},
+		{
+			name: "KMS",
+			env:  map[string]string{"S3ServerSideEncryption": "aws:kms", "S3KmsKeyId": "key-1"},
+			headers: map[string]string{
+				"X-Amz-Server-Side-Encryption":                "aws:kms",
+				"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "key-1",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{
+				"ObjectStoreType":   "s3",
+				"ObjectStorePrefix": "archive/",
+				"S3Bucket":          "bucket",
+				"S3Region":          "us-east-1",
+				"S3UseSSL":          "false",
+				"S3AccessKey":       "access",
+				"S3SecretKey":       "secret",
+			}
+			for name, value := range test.env {
+				env[name] = value
+			}
+			s := newObjectServer(t, env, http.StatusOK)
+			endpoint, _ := url.Parse(s.URL)
+			t.Setenv("S3Endpoint", endpoint.Host)
+
+			if err := SendToObjectStore(archiveRecords(), "MdeTimeline"); err != nil {
+				t.Fatal(err)
+			}
+			objects := s.sortedObjects()
+			checkArchive(t, objects, "/bucket/archive/")
+			for _, object := range objects {
+				for name, value := range test.headers {
+					if got := object.Header.Get(name); got != value {
+						t.Errorf("object %s has %s %q, want %q", object.Path, name, got, value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestObjectStoreS3Errors(t *testing.T) {
+	s := newObjectServer(t, map[string]string{
+		"ObjectStoreType": "s3",
+		"S3Bucket":        "bucket",
+		"S3Region":        "us-east-1",
+		"S3UseSSL":        "false",
+		"S3AccessKey":     "access",
+		"S3SecretKey":     "secret",
+	}, http.StatusForbidden)
+	endpoint, _ := url.Parse(s.URL)
+	t.Setenv("S3Endpoint", endpoint.Host)
+
+	if err := SendToObjectStore(archiveRecords(), "MdeTimeline"); err == nil {
+		t.Error("a rejected upload did not fail")
+	}
+
+	t.Setenv("S3ServerSideEncryption", "SSE-C")
+	if err := SendToObjectStore(archiveRecords(), "MdeTimeline"); err == nil || !strings.Contains(err.Error(), "S3ServerSideEncryption") {
+		t.Errorf("unsupported encryption returned %v", err)
+	}
+}
+
+func TestObjectStoreAzureBlob(t *testing.T) {
+	s := newObjectServer(t, map[string]string{
+		"ObjectStoreType":          "azblob",
+		"AzureBlobContainer":       "archive",
+		"AzureBlobEncryptionScope": "scope-1",
+	}, http.StatusCreated)
+	t.Setenv("AzureBlobConnectionString", "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;"+
+		"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;"+
+		"BlobEndpoint="+s.URL+"/devstoreaccount1;")
+
+	if err := SendToObjectStore(archiveRecords(), "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	objects := s.sortedObjects()
+	checkArchive(t, objects, "/devstoreaccount1/archive/")
+	for _, object := range objects {
+		for name, value := range map[string]string{
+			"X-Ms-Blob-Type":         "BlockBlob",
+			"X-Ms-Blob-Content-Type": "application/gzip",
+			"X-Ms-Encryption-Scope":  "scope-1",
+		} {
+			if got := object.Header.Get(name); got != value {
+				t.Errorf("blob %s has %s %q, want %q", object.Path, name, got, value)
+			}
+		}
+	}
+}
+
+func TestGzipNDJSON(t *testing.T) {
+	data, err := gzipNDJSON([]Record{{"a": 1.0}, {"b": "x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "{\"a\":1}\n{\"b\":\"x\"}\n" {
+		t.Errorf("decompressed body %q", body)
+	}
+}
@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// otlpBatchSize and otlpBatchBytes keep each export below the 4 MiB
+	// default receive limit of the OpenTelemetry Collector.
+	otlpBatchSize  = 1000
+	otlpBatchBytes = 3 * 1024 * 1024
+	otlpTimeout    = 30 * time.Second
+)
+
+// SendToOTLP exports records as OpenTelemetry log records over OTLP/HTTP or
+// OTLP/gRPC. The body is the JSON record, the timestamp its TimeGenerated,
+// and the table, tenant and machine id are set as attributes.
+func SendToOTLP(records []Record, table string) error {
+	endpoint := os.Getenv("OtlpEndpoint")
+	if endpoint == "" {
+		return fmt.Errorf("OtlpEndpoint is not set")
+	}
+	protocol := strings.ToLower(os.Getenv("OtlpProtocol"))
+	if protocol == "" {
+		protocol = "http"
+	}
+	headers := parseOTLPHeaders(os.Getenv("OtlpHeaders"))
+	skipVerify := os.Getenv("OtlpInsecure") == "true"
+
+	var export func(*collogspb.ExportLogsServiceRequest) error
+	switch protocol {
+	case "http":
+		client := &http.Client{Timeout: otlpTimeout}
+		if skipVerify {
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+		url := strings.TrimRight(endpoint, "/")
+		if !strings.HasSuffix(url, "/v1/logs") {
+			url += "/v1/logs"
+		}
+		export = func(request *collogspb.ExportLogsServiceRequest) error {
+			return exportOTLPHTTP(client, url, headers, request)
+		}
+	case "grpc":
+		conn, err := dialOTLP(endpoint, skipVerify)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		client := collogspb.NewLogsServiceClient(conn)
+		export = func(request *collogspb.ExportLogsServiceRequest) error {
+			return exportOTLPGRPC(client, headers, request)
+		}
+	default:
+		return fmt.Errorf("unsupported OtlpProtocol %q, use http or grpc", protocol)
+	}
+
+	log.Println("↳ Sending data to OTLP for table:", table)
+	var batch []*logspb.LogRecord
+	var size int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := export(otlpRequest(batch, records[0]))
+		batch, size = nil, 0
+		return err
+	}
+	for _, record := range records {
+		logRecord, err := otlpLogRecord(record, table)
+		if err != nil {
+			return err
+		}
+		recordSize := proto.Size(logRecord)
+		if len(batch) == otlpBatchSize || (len(batch) > 0 && size+recordSize > otlpBatchBytes) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, logRecord)
+		size += recordSize
+	}
+	return flush()
+}
+
+// otlpLogRecord maps a record onto a log record.
+func otlpLogRecord(record Record, table string) (*logspb.LogRecord, error) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	observed := time.Now()
+	if harvestTime, ok := parseTime(fieldString(record, "HarvestTime")); ok {
+		observed = harvestTime
+	}
+
+	attributes := []*commonpb.KeyValue{otlpString("table", table)}
+	for _, attribute := range [][2]string{
+		{"tenant.id", "TenantId"},
+		{"host.id", "MachineId"},
+		{"log.record.uid", "RecordId"},
+	} {
+		if value := fieldString(record, attribute[1]); value != "" {
+			attributes = append(attributes, otlpString(attribute[0], value))
+		}
+	}
+
+	return &logspb.LogRecord{
+		TimeUnixNano:         uint64(recordTimeGenerated(record).UnixNano()),
+		ObservedTimeUnixNano: uint64(observed.UnixNano()),
+		SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+		SeverityText:         "INFO",
+		Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(body)}},
+		Attributes:           attributes,
+	}, nil
+}
+
+// otlpRequest wraps log records in a request with the harvester as resource.
+func otlpRequest(logRecords []*logspb.LogRecord, sample Record) *collogspb.ExportLogsServiceRequest {
+	version := fieldString(sample, "HarvesterVersion")
+	return &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{
+				Attributes: []*commonpb.KeyValue{
+					otlpString("service.name", "defenderharvester"),
+					otlpString("service.version", version),
+				},
+			},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope:      &commonpb.InstrumentationScope{Name: "defenderharvester", Version: version},
+				LogRecords: logRecords,
+			}},
+		}},
+	}
+}
+
+func otlpString(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// parseOTLPHeaders parses key=value pairs separated by commas, the format of
+// OTEL_EXPORTER_OTLP_HEADERS.
+func parseOTLPHeaders(list string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if ok && strings.TrimSpace(key) != "" {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return headers
+}
+
+func exportOTLPHTTP(client *http.Client, url string, headers map[string]string, request *collogspb.ExportLogsServiceRequest) error {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal OTLP request: %w", err)
+	}
+
+	resp, err := doWithRetry(client, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("OTLP endpoint returned status code %s: %s", resp.Status, data)
+	}
+	var response collogspb.ExportLogsServiceResponse
+	if err := proto.Unmarshal(data, &response); err == nil {
+		return otlpPartialSuccess(&response)
+	}
+	return nil
+}
+
+// dialOTLP connects to a gRPC receiver. An http:// endpoint is plaintext,
+// anything else uses TLS.
+func dialOTLP(endpoint string, skipVerify bool) (*grpc.ClientConn, error) {
+	creds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: skipVerify})
+	target := endpoint
+	switch {
+	case strings.HasPrefix(endpoint, "http://"):
+		creds = insecure.NewCredentials()
+		target = strings.TrimPrefix(endpoint, "http://")
+	case strings.HasPrefix(endpoint, "https://"):
+		target = strings.TrimPrefix(endpoint, "https://")
+	}
+
+	conn, err := grpc.NewClient(strings.TrimRight(target, "/"), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", endpoint, err)
+	}
+	return conn, nil
+}
+
+func exportOTLPGRPC(client collogspb.LogsServiceClient, headers map[string]string, request *collogspb.ExportLogsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	for name, value := range headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(name), value)
+	}
+
+	response, err := client.Export(ctx, request)
+	if err != nil {
+		return fmt.Errorf("failed to export logs: %w", err)
+	}
+	return otlpPartialSuccess(response)
+}
+
+// otlpPartialSuccess fails the export when the receiver rejected records.
+func otlpPartialSuccess(response *collogspb.ExportLogsServiceResponse) error {
+	if partial := response.GetPartialSuccess(); partial != nil && partial.GetRejectedLogRecords() > 0 {
+		return fmt.Errorf("OTLP endpoint rejected %d log records: %s", partial.GetRejectedLogRecords(), partial.GetErrorMessage())
+	}
+	return nil
+}
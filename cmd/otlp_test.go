@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpReceiver records the export requests of an OTLP/HTTP stand-in.
+type otlpReceiver struct {
+	mu       sync.Mutex
+	requests []*collogspb.ExportLogsServiceRequest
+	headers  []http.Header
+}
+
+func newOTLPReceiver(t *testing.T, response *collogspb.ExportLogsServiceResponse) (*httptest.Server, *otlpReceiver) {
+	t.Helper()
+	receiver := &otlpReceiver{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected request to %s with content type %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		request := &collogspb.ExportLogsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			t.Errorf("invalid ExportLogsServiceRequest: %v", err)
+		}
+		receiver.mu.Lock()
+		receiver.requests = append(receiver.requests, request)
+		receiver.headers = append(receiver.headers, r.Header.Clone())
+		receiver.mu.Unlock()
+		data, _ := proto.Marshal(response)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(data)
+	}))
+	t.Cleanup(s.Close)
+	t.Setenv("OtlpEndpoint", s.URL)
+	t.Setenv("OtlpProtocol", "http")
+	t.Setenv("OtlpHeaders", "")
+	t.Setenv("OtlpInsecure", "")
+	return s, receiver
+}
+
+func otlpAttributes(attributes []*commonpb.KeyValue) map[string]string {
+	values := make(map[string]string, len(attributes))
+	for _, attribute := range attributes {
+		values[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+	return values
+}
+
+func otlpTestRecord() Record {
+	return Record{
+		"RecordId":         "r1",
+		"TenantId":         "t1",
+		"MachineId":        "m1",
+		"TimeGenerated":    "2024-03-05T10:00:00Z",
+		"HarvestTime":      "2024-03-05T11:00:00Z",
+		"HarvesterVersion": "1.2.3",
+		"ActionType":       "ProcessCreated",
+	}
+}
+
+// checkOTLPRequest verifies the mapping of otlpTestRecord.
+func checkOTLPRequest(t *testing.T, request *collogspb.ExportLogsServiceRequest) {
+	t.Helper()
+	resourceLogs := request.GetResourceLogs()
+	if len(resourceLogs) != 1 || len(resourceLogs[0].GetScopeLogs()) != 1 {
+		t.Fatalf("request %v, want one resource and scope", request)
+	}
+	resource := otlpAttributes(resourceLogs[0].GetResource().GetAttributes())
+	if resource["service.name"] != "defenderharvester" || resource["service.version"] != "1.2.3" {
+		t.Errorf("resource attributes %v", resource)
+	}
+	logRecords := resourceLogs[0].GetScopeLogs()[0].GetLogRecords()
+	if len(logRecords) != 1 {
+		t.Fatalf("%d log records, want 1", len(logRecords))
+	}
+	logRecord := logRecords[0]
+
+	var body Record
+	if err := json.Unmarshal([]byte(logRecord.GetBody().GetStringValue()), &body); err != nil {
+		t.Fatalf("body is not the JSON record: %v", err)
+	}
+	if !reflect.DeepEqual(body, otlpTestRecord()) {
+		t.Errorf("body %v", body)
+	}
+	if want := uint64(time.Date(2024, 3, 5, 10, 0, 0, 0, time.UTC).UnixNano()); logRecord.GetTimeUnixNano() != want {
+		t.Errorf("timestamp %d, want TimeGenerated %d", logRecord.GetTimeUnixNano(), want)
+	}
+	if want := uint64(time.Date(2024, 3, 5, 11, 0, 0, 0, time.UTC).UnixNano()); logRecord.GetObservedTimeUnixNano() != want {
+		t.Errorf("observed timestamp %d, want HarvestTime %d", logRecord.GetObservedTimeUnixNano(), want)
+	}
+	want := map[string]string{
+		"table":          "MdeTimeline",
+		"tenant.id":      "t1",
+		"host.id":        "m1",
+		"log.record.uid": "r1",
+	}
+	if attributes := otlpAttributes(logRecord.GetAttributes()); !reflect.DeepEqual(attributes, want) {
+		t.Errorf("attributes %v, want %v", attributes, want)
+	}
+}
+
+func TestSendToOTLPHTTP(t *testing.T) {
+	_, receiver := newOTLPReceiver(t, &collogspb.ExportLogsServiceResponse{})
+	t.Setenv("OtlpHeaders", "Authorization=Bearer token, X-Scope-OrgID=org1")
+
+	if err := SendToOTLP([]Record{otlpTestRecord()}, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	if len(receiver.requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(receiver.requests))
+	}
+	checkOTLPRequest(t, receiver.requests[0])
+	if receiver.headers[0].Get("Authorization") != "Bearer token" || receiver.headers[0].Get("X-Scope-OrgID") != "org1" {
+		t.Errorf("headers %v", receiver.headers[0])
+	}
+}
+
+func TestSendToOTLPBatches(t *testing.T) {
+	_, receiver := newOTLPReceiver(t, &collogspb.ExportLogsServiceResponse{})
+	records := make([]Record, otlpBatchSize+1)
+	for i := range records {
+		records[i] = Record{"n": i}
+	}
+	if err := SendToOTLP(records, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	for _, request := range receiver.requests {
+		sizes = append(sizes, len(request.GetResourceLogs()[0].GetScopeLogs()[0].GetLogRecords()))
+	}
+	if !reflect.DeepEqual(sizes, []int{otlpBatchSize, 1}) {
+		t.Errorf("batch sizes %v", sizes)
+	}
+}
+
+func TestSendToOTLPPartialSuccess(t *testing.T) {
+	newOTLPReceiver(t, &collogspb.ExportLogsServiceResponse{
+		PartialSuccess: &collogspb.ExportLogsPartialSuccess{RejectedLogRecords: 1, ErrorMessage: "too old"},
+	})
+	if err := SendToOTLP([]Record{otlpTestRecord()}, "MdeTimeline"); err == nil {
+		t.Error("rejected log records did not fail the export")
+	}
+}
+
+// logsService is an OTLP/gRPC stand-in.
+type logsService struct {
+	collogspb.UnimplementedLogsServiceServer
+	requests []*collogspb.ExportLogsServiceRequest
+	metadata []metadata.MD
+}
+
+func (s *logsService) Export(ctx context.Context, request *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.requests = append(s.requests, request)
+	s.metadata = append(s.metadata, md)
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func TestSendToOTLPGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	service := &logsService{}
+	collogspb.RegisterLogsServiceServer(server, service)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	t.Setenv("OtlpEndpoint", "http://"+listener.Addr().String())
+	t.Setenv("OtlpProtocol", "grpc")
+	t.Setenv("OtlpHeaders", "X-Scope-OrgID=org1")
+	t.Setenv("OtlpInsecure", "")
+
+	if err := SendToOTLP([]Record{otlpTestRecord()}, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	if len(service.requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(service.requests))
+	}
+	checkOTLPRequest(t, service.requests[0])
+	if orgs := service.metadata[0].Get("x-scope-orgid"); len(orgs) != 1 || orgs[0] != "org1" {
+		t.Errorf("metadata %v", service.metadata[0])
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	tests := map[string]map[string]string{
+		"":                          {},
+		"Authorization=Bearer a=b":  {"Authorization": "Bearer a=b"},
+		" A = 1 , B=2,,=3,invalid ": {"A": "1", "B": "2"},
+		"X-Empty=":                  {"X-Empty": ""},
+	}
+	for list, want := range tests {
+		if got := parseOTLPHeaders(list); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseOTLPHeaders(%q) = %v, want %v", list, got, want)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	tableAPIVersion = "2022-10-01"
+	dcrAPIVersion   = "2022-06-01"
+)
+
+// harvestColumns are added to every record by Enrich and dedupe.
+var harvestColumns = []SchemaColumn{
+	{Name: "TimeGenerated", Type: "datetime"},
+	{Name: "HarvestTime", Type: "datetime"},
+	{Name: "TenantId", Type: "string"},
+	{Name: "Region", Type: "string"},
+	{Name: "SourceEndpoint", Type: "string"},
+	{Name: "CollectorName", Type: "string"},
+	{Name: "HarvesterVersion", Type: "string"},
+	{Name: "RecordId", Type: "string"},
+}
+
+var (
+	// laColumnName is a valid Log Analytics column name.
+	laColumnName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,44}$`)
+	// laReservedColumns can not be used in custom tables.
+	laReservedColumns  = []string{"id", "TenantId", "Type", "_ResourceId", "_SubscriptionId", "_ItemId", "_BilledSize", "_IsBillable", "_TimeReceived"}
+	invalidColumnChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+)
+
+// ProvisionColumn is a column of a custom table. Source is the field name in
+// the records, which differs from Name when the field is not a valid or a
+// reserved Log Analytics column name.
+type ProvisionColumn struct {
+	Name   string
+	Source string
+	Type   string
+}
+
+// ProvisionTable is a Sentinel custom table with the DCR stream feeding it.
+type ProvisionTable struct {
+	// Table is the collector table, the custom table is Table_CL.
+	Table   string
+	Columns []ProvisionColumn
+}
+
+// CustomTable returns the name of the Log Analytics custom table.
+func (t ProvisionTable) CustomTable() string {
+	return t.Table + "_CL"
+}
+
+// Stream returns the name of the DCR input stream.
+func (t ProvisionTable) Stream() string {
+	return logsIngestionStream(t.Table)
+}
+
+// TransformKQL returns the DCR transformation, renaming fields that are not
+// valid column names.
+func (t ProvisionTable) TransformKQL() string {
+	var renames []string
+	for _, column := range t.Columns {
+		if column.Name != column.Source {
+			renames = append(renames, fmt.Sprintf("%s = ['%s']", column.Name, column.Source))
+		}
+	}
+	if len(renames) == 0 {
+		return "source"
+	}
+	return "source | project-rename " + strings.Join(renames, ", ")
+}
+
+// ProvisionTables derives the custom tables of the given collector tables, all
+// known and sampled tables when empty. The columns are the harvest metadata,
+// the columns the collector declares and the fields seen in the sample
+// records. Tables without declared columns or samples are skipped.
+func ProvisionTables(tables []string, samples map[string][]Record) []ProvisionTable {
+	if len(tables) == 0 {
+		seen := make(map[string]bool)
+		for table, collector := range collectors {
+			if len(collector.Columns) > 0 {
+				seen[table] = true
+			}
+		}
+		for table := range samples {
+			seen[table] = true
+		}
+		for table := range seen {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+	}
+
+	var provisioned []ProvisionTable
+	for _, table := range tables {
+		declared := collectorFor(table).Columns
+		if len(declared) == 0 && len(samples[table]) == 0 {
+			log.Printf("Skipping %s, it has no declared columns and no sample records\n", table)
+			continue
+		}
+
+		columns := append(append([]SchemaColumn{}, harvestColumns...), declared...)
+		columns = append(columns, sampleColumns(samples[table])...)
+
+		result := ProvisionTable{Table: table}
+		names := make(map[string]bool)
+		sources := make(map[string]bool)
+		for _, column := range columns {
+			if sources[column.Name] {
+				continue
+			}
+			sources[column.Name] = true
+
+			name := laName(column.Name)
+			if names[strings.ToLower(name)] {
+				log.Printf("Skipping %s.%s, its column name %s is already used\n", table, column.Name, name)
+				continue
+			}
+			names[strings.ToLower(name)] = true
+			result.Columns = append(result.Columns, ProvisionColumn{Name: name, Source: column.Name, Type: column.Type})
+		}
+		provisioned = append(provisioned, result)
+	}
+	return provisioned
+}
+
+// laName turns a field name into a valid, unreserved column name.
+func laName(field string) string {
+	name := field
+	for _, reserved := range laReservedColumns {
+		if strings.EqualFold(name, reserved) {
+			name += "_"
+		}
+	}
+	if laColumnName.MatchString(name) {
+		return name
+	}
+	name = strings.Trim(invalidColumnChars.ReplaceAllString(name, "_"), "_")
+	if name == "" || !(name[0] >= 'A' && name[0] <= 'Z' || name[0] >= 'a' && name[0] <= 'z') {
+		name = "c_" + name
+	}
+	if len(name) > 45 {
+		name = name[:45]
+	}
+	return name
+}
+
+// sampleColumns infers the columns of sample records, sorted by name. A
+// column holding values of different types is a string, except for whole
+// and fractional numbers which are real.
+func sampleColumns(records []Record) []SchemaColumn {
+	types := make(map[string]string)
+	for _, record := range records {
+		for field, value := range record {
+			kind := laType(value)
+			if kind == "" {
+				if _, ok := types[field]; !ok {
+					types[field] = ""
+				}
+				continue
+			}
+			switch existing := types[field]; {
+			case existing == "" || existing == kind:
+				types[field] = kind
+			case (existing == "long" && kind == "real") || (existing == "real" && kind == "long"):
+				types[field] = "real"
+			default:
+				types[field] = "string"
+			}
+		}
+	}
+
+	columns := make([]SchemaColumn, 0, len(types))
+	for field, kind := range types {
+		if kind == "" {
+			kind = "string"
+		}
+		columns = append(columns, SchemaColumn{Name: field, Type: kind})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].Name < columns[j].Name })
+	return columns
+}
+
+// laType returns the Log Analytics type of a JSON value, or an empty string
+// for null.
+func laType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return "long"
+		}
+		return "real"
+	case string:
+		if _, ok := parseTime(v); ok {
+			return "datetime"
+		}
+		return "string"
+	}
+	return "dynamic"
+}
+
+// LoadSamples reads the records in the NDJSON files written by -files in dir,
+// grouped by their CollectorName.
+func LoadSamples(dir string) (map[string][]Record, error) {
+	var files []string
+	for _, pattern := range []string{"*.ndjson", "*.ndjson.gz", "*.ndjson.zst"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no NDJSON files found in %s", dir)
+	}
+
+	samples := make(map[string][]Record)
+	for _, file := range files {
+		records, err := readNDJSON(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if table := fieldString(record, "CollectorName"); table != "" {
+				samples[table] = append(samples[table], record)
+			}
+		}
+	}
+	return samples, nil
+}
+
+func readNDJSON(filename string) ([]Record, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch filepath.Ext(filename) {
+	case ".gz":
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		defer zr.Close()
+		r = zr
+	case ".zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("failed to decode a record in %s: %w", filename, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return records, nil
+}
+
+// dcrName is the data collection rule of a table.
+func dcrName(table string) string {
+	return "dcr-defenderharvester-" + strings.ToLower(table)
+}
+
+// dcrOutput is the template output holding the immutable id of the data
+// collection rule of a table, named after the variable logsIngestionRule reads.
+func dcrOutput(table string) string {
+	return "SentinelDcrImmutableId_" + table
+}
+
+func tableColumns(columns []ProvisionColumn, source bool) []map[string]string {
+	list := make([]map[string]string, 0, len(columns))
+	for _, column := range columns {
+		name := column.Name
+		if source {
+			name = column.Source
+		}
+		list = append(list, map[string]string{"name": name, "type": column.Type})
+	}
+	return list
+}
+
+func tableProperties(table ProvisionTable, retention interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"retentionInDays": retention,
+		"schema": map[string]interface{}{
+			"name":    table.CustomTable(),
+			"columns": tableColumns(table.Columns, false),
+		},
+	}
+}
+
+func dcrProperties(table ProvisionTable, endpointID interface{}, workspaceID interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"dataCollectionEndpointId": endpointID,
+		"streamDeclarations": map[string]interface{}{
+			table.Stream(): map[string]interface{}{"columns": tableColumns(table.Columns, true)},
+		},
+		"destinations": map[string]interface{}{
+			"logAnalytics": []map[string]interface{}{{"name": "workspace", "workspaceResourceId": workspaceID}},
+		},
+		"dataFlows": []map[string]interface{}{{
+			"streams":      []string{table.Stream()},
+			"destinations": []string{"workspace"},
+			"transformKql": table.TransformKQL(),
+			"outputStream": table.Stream(),
+		}},
+	}
+}
+
+// RenderARM writes an ARM template deploying the custom tables into a
+// workspace and a data collection rule per table. The immutable ids of the
+// rules are output under the names of the environment variables the Sentinel
+// sink reads them from.
+func RenderARM(w io.Writer, tables []ProvisionTable) error {
+	var resources []map[string]interface{}
+	outputs := map[string]interface{}{}
+	for _, table := range tables {
+		outputs[dcrOutput(table.Table)] = map[string]interface{}{
+			"type":  "string",
+			"value": fmt.Sprintf("[reference(resourceId('Microsoft.Insights/dataCollectionRules', '%s'), '%s').immutableId]", dcrName(table.Table), dcrAPIVersion),
+		}
+		tableID := fmt.Sprintf("[resourceId('Microsoft.OperationalInsights/workspaces/tables', parameters('workspaceName'), '%s')]", table.CustomTable())
+		resources = append(resources,
+			map[string]interface{}{
+				"type":       "Microsoft.OperationalInsights/workspaces/tables",
+				"apiVersion": tableAPIVersion,
+				"name":       fmt.Sprintf("[format('{0}/{1}', parameters('workspaceName'), '%s')]", table.CustomTable()),
+				"properties": tableProperties(table, "[parameters('retentionInDays')]"),
+			},
+			map[string]interface{}{
+				"type":       "Microsoft.Insights/dataCollectionRules",
+				"apiVersion": dcrAPIVersion,
+				"name":       dcrName(table.Table),
+				"location":   "[parameters('location')]",
+				"dependsOn":  []string{tableID},
+				"properties": dcrProperties(table,
+					"[parameters('dataCollectionEndpointId')]",
+					"[resourceId('Microsoft.OperationalInsights/workspaces', parameters('workspaceName'))]"),
+			})
+	}
+
+	template := map[string]interface{}{
+		"$schema":        "https://schema.management.azure.com/schemas/2019-04-01/deploymentTemplate.json#",
+		"contentVersion": "1.0.0.0",
+		"parameters": map[string]interface{}{
+			"workspaceName":            map[string]interface{}{"type": "string"},
+			"dataCollectionEndpointId": map[string]interface{}{"type": "string"},
+			"location":                 map[string]interface{}{"type": "string", "defaultValue": "[resourceGroup().location]"},
+			"retentionInDays":          map[string]interface{}{"type": "int", "defaultValue": 90},
+		},
+		"resources": resources,
+		"outputs":   outputs,
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(template)
+}
+
+// RenderProvisionJSON writes the request bodies of the tables and data
+// collection rules, for deploying them through the REST API. The endpoint and
+// workspace ids are left as placeholders.
+func RenderProvisionJSON(w io.Writer, tables []ProvisionTable) error {
+	tableBodies := map[string]interface{}{}
+	dcrBodies := map[string]interface{}{}
+	for _, table := range tables {
+		tableBodies[table.CustomTable()] = map[string]interface{}{"properties": tableProperties(table, 90)}
+		dcrBodies[dcrName(table.Table)] = map[string]interface{}{
+			"location":   "<location>",
+			"properties": dcrProperties(table, "<dataCollectionEndpointId>", "<workspaceResourceId>"),
+		}
+	}
+	output := map[string]interface{}{"tables": tableBodies, "dataCollectionRules": dcrBodies}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(output)
+}
+
+// RenderBicep writes a Bicep file with the same resources as RenderARM.
+func RenderBicep(w io.Writer, tables []ProvisionTable) {
+	fmt.Fprintln(w, "param workspaceName string")
+	fmt.Fprintln(w, "param dataCollectionEndpointId string")
+	fmt.Fprintln(w, "param location string = resourceGroup().location")
+	fmt.Fprintln(w, "param retentionInDays int = 90")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "resource workspace 'Microsoft.OperationalInsights/workspaces@%s' existing = {\n  name: workspaceName\n}\n", tableAPIVersion)
+
+	columns := func(indent string, list []map[string]string) {
+		for _, column := range list {
+			fmt.Fprintf(w, "%s{ name: %s, type: %s }\n", indent, bicepString(column["name"]), bicepString(column["type"]))
+		}
+	}
+	for i, table := range tables {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "resource table%d 'Microsoft.OperationalInsights/workspaces/tables@%s' = {\n", i, tableAPIVersion)
+		fmt.Fprintln(w, "  parent: workspace")
+		fmt.Fprintf(w, "  name: %s\n", bicepString(table.CustomTable()))
+		fmt.Fprintln(w, "  properties: {")
+		fmt.Fprintln(w, "    retentionInDays: retentionInDays")
+		fmt.Fprintln(w, "    schema: {")
+		fmt.Fprintf(w, "      name: %s\n", bicepString(table.CustomTable()))
+		fmt.Fprintln(w, "      columns: [")
+		columns("        ", tableColumns(table.Columns, false))
+		fmt.Fprintln(w, "      ]")
+		fmt.Fprintln(w, "    }")
+		fmt.Fprintln(w, "  }")
+		fmt.Fprintln(w, "}")
+
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "resource dcr%d 'Microsoft.Insights/dataCollectionRules@%s' = {\n", i, dcrAPIVersion)
+		fmt.Fprintf(w, "  name: %s\n", bicepString(dcrName(table.Table)))
+		fmt.Fprintln(w, "  location: location")
+		fmt.Fprintf(w, "  dependsOn: [\n    table%d\n  ]\n", i)
+		fmt.Fprintln(w, "  properties: {")
+		fmt.Fprintln(w, "    dataCollectionEndpointId: dataCollectionEndpointId")
+		fmt.Fprintln(w, "    streamDeclarations: {")
+		fmt.Fprintf(w, "      %s: {\n", bicepString(table.Stream()))
+		fmt.Fprintln(w, "        columns: [")
+		columns("          ", tableColumns(table.Columns, true))
+		fmt.Fprintln(w, "        ]")
+		fmt.Fprintln(w, "      }")
+		fmt.Fprintln(w, "    }")
+		fmt.Fprintln(w, "    destinations: {")
+		fmt.Fprintln(w, "      logAnalytics: [")
+		fmt.Fprintln(w, "        { name: 'workspace', workspaceResourceId: workspace.id }")
+		fmt.Fprintln(w, "      ]")
+		fmt.Fprintln(w, "    }")
+		fmt.Fprintln(w, "    dataFlows: [")
+		fmt.Fprintln(w, "      {")
+		fmt.Fprintf(w, "        streams: [ %s ]\n", bicepString(table.Stream()))
+		fmt.Fprintln(w, "        destinations: [ 'workspace' ]")
+		fmt.Fprintf(w, "        transformKql: %s\n", bicepString(table.TransformKQL()))
+		fmt.Fprintf(w, "        outputStream: %s\n", bicepString(table.Stream()))
+		fmt.Fprintln(w, "      }")
+		fmt.Fprintln(w, "    ]")
+		fmt.Fprintln(w, "  }")
+		fmt.Fprintln(w, "}")
+	}
+
+	if len(tables) > 0 {
+		fmt.Fprintln(w)
+	}
+	for i, table := range tables {
+		fmt.Fprintf(w, "output %s string = dcr%d.properties.immutableId\n", dcrOutput(table.Table), i)
+	}
+}
+
+// bicepString quotes a Bicep string literal.
+func bicepString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "$", `\$`, "\n", `\n`).Replace(value) + "'"
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLaType(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, ""},
+		{true, "boolean"},
+		{float64(42), "long"},
+		{1.5, "real"},
+		{float64(1 << 60), "real"},
+		{"2024-03-05T10:00:00Z", "datetime"},
+		{"host-1", "string"},
+		{map[string]interface{}{"a": 1}, "dynamic"},
+		{[]interface{}{"a"}, "dynamic"},
+	}
+	for _, test := range tests {
+		if got := laType(test.value); got != test.want {
+			t.Errorf("laType(%v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestSampleColumns(t *testing.T) {
+	records := []Record{
+		{"Count": float64(1), "Score": float64(1), "Mixed": true, "Empty": nil, "Seen": "2024-03-05T10:00:00Z"},
+		{"Count": float64(2), "Score": 0.5, "Mixed": "yes", "Empty": nil, "Tags": []interface{}{"a"}},
+	}
+	want := []SchemaColumn{
+		{Name: "Count", Type: "long"},
+		{Name: "Empty", Type: "string"},
+		{Name: "Mixed", Type: "string"},
+		{Name: "Score", Type: "real"},
+		{Name: "Seen", Type: "datetime"},
+		{Name: "Tags", Type: "dynamic"},
+	}
+	if got := sampleColumns(records); !reflect.DeepEqual(got, want) {
+		t.Errorf("columns %v, want %v", got, want)
+	}
+}
+
+func TestLaName(t *testing.T) {
+	tests := map[string]string{
+		"DeviceName":            "DeviceName",
+		"id":                    "id_",
+		"Type":                  "Type_",
+		"_ResourceId":           "ResourceId",
+		"Device.Name":           "Device_Name",
+		"1stSeen":               "c_1stSeen",
+		"@odata.type":           "odata_type",
+		strings.Repeat("a", 50): strings.Repeat("a", 45),
+	}
+	for field, want := range tests {
+		if got := laName(field); got != want {
+			t.Errorf("laName(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestProvisionTables(t *testing.T) {
+	samples := map[string][]Record{
+		"MdeCustom": {{"id": "a1", "Type": "x", "Device.Name": "host-1", "Count": float64(3), "TenantId": "t1"}},
+	}
+	tables := ProvisionTables([]string{"MdeCustom", "MdeUnknown"}, samples)
+	if len(tables) != 1 {
+		t.Fatalf("%d tables, want the table without columns or samples skipped", len(tables))
+	}
+	table := tables[0]
+	if table.CustomTable() != "MdeCustom_CL" || table.Stream() != "Custom-MdeCustom_CL" {
+		t.Errorf("table %s, stream %s", table.CustomTable(), table.Stream())
+	}
+
+	columns := make(map[string]ProvisionColumn)
+	for _, column := range table.Columns {
+		if _, ok := columns[column.Source]; ok {
+			t.Errorf("field %s has two columns", column.Source)
+		}
+		columns[column.Source] = column
+	}
+	for _, column := range harvestColumns {
+		if _, ok := columns[column.Name]; !ok {
+			t.Errorf("harvest column %s is missing", column.Name)
+		}
+	}
+	want := map[string]ProvisionColumn{
+		"id":          {Name: "id_", Source: "id", Type: "string"},
+		"Type":        {Name: "Type_", Source: "Type", Type: "string"},
+		"Device.Name": {Name: "Device_Name", Source: "Device.Name", Type: "string"},
+		"Count":       {Name: "Count", Source: "Count", Type: "long"},
+		"TenantId":    {Name: "TenantId_", Source: "TenantId", Type: "string"},
+	}
+	for field, column := range want {
+		if columns[field] != column {
+			t.Errorf("column of %s is %+v, want %+v", field, columns[field], column)
+		}
+	}
+
+	kql := table.TransformKQL()
+	if !strings.HasPrefix(kql, "source | project-rename ") {
+		t.Fatalf("transformation %q does not rename", kql)
+	}
+	for _, rename := range []string{"TenantId_ = ['TenantId']", "id_ = ['id']", "Type_ = ['Type']", "Device_Name = ['Device.Name']"} {
+		if !strings.Contains(kql, rename) {
+			t.Errorf("transformation %q does not contain %s", kql, rename)
+		}
+	}
+	if strings.Contains(kql, "Count") {
+		t.Errorf("transformation %q renames a valid column", kql)
+	}
+	if kql := (ProvisionTable{Table: "MdeRoles", Columns: []ProvisionColumn{{Name: "Id", Source: "Id"}}}).TransformKQL(); kql != "source" {
+		t.Errorf("transformation %q, want the source as is", kql)
+	}
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	// RolesTable holds the MDE roles with their permissions and assigned
+	// Azure AD groups.
+	RolesTable = "MdeRoles"
+	// RoleMachineGroupsTable maps roles onto the machine groups they apply to.
+	RoleMachineGroupsTable = "MdeRoleMachineGroups"
+)
+
+// roleMachineGroupColumns declares the role mapping records for provisioning.
+var roleMachineGroupColumns = []SchemaColumn{
+	{Name: "RoleId", Type: "string"},
+	{Name: "RoleName", Type: "string"},
+	{Name: "MachineGroupId", Type: "string"},
+	{Name: "MachineGroupName", Type: "string"},
+	{Name: "AadGroupIds", Type: "dynamic"},
+	{Name: "AadGroupNames", Type: "dynamic"},
+}
+
+// Fields holding the Azure AD groups assigned to a role or given access to a
+// machine group, in order of preference.
+var (
+	roleGroupFields         = []string{"AssignedUserGroups", "UserGroups", "AadGroups"}
+	machineGroupGroupFields = []string{"MachineGroupAssignments", "UserGroups", "AadGroups"}
+)
+
+// GetRBACRoles retrieves the roles from rolesEndpoint and the machine groups
+// from machineGroupsEndpoint, and delivers the roles as well as the mapping of
+// each role onto the machine groups that share one of its Azure AD groups.
+func GetRBACRoles(cfg Config, rolesEndpoint string, machineGroupsEndpoint string, location string) error {
+	resource := fmt.Sprintf("https://%s.securitycenter.windows.com", location)
+
+	body, err := fetchServiceAPI(cfg, resource+rolesEndpoint)
+	if err != nil {
+		return err
+	}
+	roles, err := DecodeRecords(body)
+	if err != nil {
+		return err
+	}
+
+	body, err = fetchServiceAPI(cfg, resource+machineGroupsEndpoint)
+	if err != nil {
+		return err
+	}
+	machineGroups, err := DecodeRecords(body)
+	if err != nil {
+		return err
+	}
+
+	if err := deliver(cfg, RolesTable, location+".securitycenter.windows.com"+rolesEndpoint, roles); err != nil {
+		return err
+	}
+	mappings := roleMachineGroups(roles, machineGroups)
+	log.Printf("Mapped %d roles onto %d machine groups\n", len(roles), len(machineGroups))
+	return deliver(cfg, RoleMachineGroupsTable, location+".securitycenter.windows.com"+machineGroupsEndpoint, mappings)
+}
+
+// roleMachineGroups returns a record for every role and machine group that
+// have at least one Azure AD group in common.
+func roleMachineGroups(roles []Record, machineGroups []Record) []Record {
+	var mappings []Record
+	for _, role := range roles {
+		roleGroups := aadGroups(role, roleGroupFields)
+		for _, machineGroup := range machineGroups {
+			machineGroupGroups := aadGroups(machineGroup, machineGroupGroupFields)
+
+			var shared []string
+			for id := range roleGroups {
+				if _, ok := machineGroupGroups[id]; ok {
+					shared = append(shared, id)
+				}
+			}
+			if len(shared) == 0 {
+				continue
+			}
+			sort.Strings(shared)
+
+			names := make([]string, 0, len(shared))
+			for _, id := range shared {
+				names = append(names, roleGroups[id])
+			}
+			mappings = append(mappings, Record{
+				"RoleId":           firstField(role, "Id", "id"),
+				"RoleName":         firstField(role, "Name", "name"),
+				"MachineGroupId":   firstField(machineGroup, "MachineGroupId", "Id", "id"),
+				"MachineGroupName": firstField(machineGroup, "Name", "name"),
+				"AadGroupIds":      shared,
+				"AadGroupNames":    names,
+			})
+		}
+	}
+	return mappings
+}
+
+// aadGroups returns the Azure AD group ids, with their display names, held in
+// the first of fields that is set. Groups are either objects or bare ids.
+func aadGroups(record Record, fields []string) map[string]string {
+	groups := make(map[string]string)
+	for _, field := range fields {
+		list, ok := record[field].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, item := range list {
+			switch group := item.(type) {
+			case string:
+				groups[strings.ToLower(group)] = group
+			case map[string]interface{}:
+				id := firstField(group, "AadGroupId", "ObjectId", "Id", "id")
+				if id == "" {
+					continue
+				}
+				name := firstField(group, "DisplayName", "Name", "name")
+				if name == "" {
+					name = id
+				}
+				groups[strings.ToLower(id)] = name
+			}
+		}
+		return groups
+	}
+	return groups
+}
+
+// firstField returns the first of fields that is set, rendered as text.
+func firstField(record Record, fields ...string) string {
+	for _, field := range fields {
+		if value := fieldString(record, field); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Record is a single harvested event as returned by the service API.
+type Record map[string]interface{}
+
+// recordListFields are the envelope properties the various service API
+// endpoints use to wrap their result sets.
+var recordListFields = []string{"Results", "results", "value", "Value", "Items", "items", "Reports", "reports"}
+
+// DecodeRecords turns a service API response into individual records. The
+// response can be a bare JSON array, an envelope object holding the array in
+// one of the recordListFields, or a single object which becomes one record.
+func DecodeRecords(body []byte) ([]Record, error) {
+	var list []Record
+	if err := json.Unmarshal(body, &list); err == nil {
+		return list, nil
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	for _, field := range recordListFields {
+		raw, ok := envelope[field]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, &list); err == nil {
+			return list, nil
+		}
+	}
+
+	var single Record
+	if err := json.Unmarshal(body, &single); err != nil {
+		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	}
+	return []Record{single}, nil
+}
+
+// nextLink returns the @odata.nextLink of a paged public API response, or an
+// empty string on the last page.
+func nextLink(body []byte) string {
+	var page struct {
+		NextLink string `json:"@odata.nextLink"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return ""
+	}
+	return page.NextLink
+}
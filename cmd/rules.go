@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// FindingsTable receives the findings of the rules over configuration changes.
+const FindingsTable = "MdeConfigFindings"
+
+// findingColumns declares the finding records for provisioning.
+var findingColumns = []SchemaColumn{
+	{Name: "RuleId", Type: "string"},
+	{Name: "Title", Type: "string"},
+	{Name: "Severity", Type: "string"},
+	{Name: "Description", Type: "string"},
+	{Name: "SourceTable", Type: "string"},
+	{Name: "ChangeType", Type: "string"},
+	{Name: "RecordKey", Type: "string"},
+	{Name: "Field", Type: "string"},
+	{Name: "OldValue", Type: "dynamic"},
+	{Name: "NewValue", Type: "dynamic"},
+	{Name: "ChangedBy", Type: "string"},
+	{Name: "ChangeTime", Type: "datetime"},
+}
+
+//go:embed rules.json
+var defaultRules []byte
+
+// Rule matches configuration changes reported to MdeSettingsChange. Empty
+// properties match anything; oldValue and newValue are only compared when
+// present in the rule file.
+type Rule struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	Disabled    bool   `json:"disabled"`
+	// Table is the SourceTable of the change.
+	Table string `json:"table"`
+	// ChangeType is added, removed or changed.
+	ChangeType string `json:"changeType"`
+	// Field is a path.Match pattern on the dotted field path. For added and
+	// removed records it selects the field inside the record.
+	Field    string          `json:"field"`
+	OldValue json.RawMessage `json:"oldValue"`
+	NewValue json.RawMessage `json:"newValue"`
+}
+
+// LoadRules returns the shipped rules, extended with the rules in file. A rule
+// in file replaces the shipped rule with the same id.
+func LoadRules(file string) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal(defaultRules, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse shipped rules: %w", err)
+	}
+	if file == "" {
+		return rules, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	var custom []Rule
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %w", file, err)
+	}
+
+	index := make(map[string]int, len(rules))
+	for i, rule := range rules {
+		index[rule.ID] = i
+	}
+	for _, rule := range custom {
+		if i, ok := index[rule.ID]; ok {
+			rules[i] = rule
+			continue
+		}
+		index[rule.ID] = len(rules)
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// EvaluateRules returns a severity-tagged finding for every change matched by
+// one of the rules.
+func EvaluateRules(rules []Rule, changes []Record) []Record {
+	var findings []Record
+	for _, change := range changes {
+		for _, rule := range rules {
+			if rule.Disabled || !rule.matches(change) {
+				continue
+			}
+			log.Printf("↳ [%s] %s: %s %v\n", rule.Severity, rule.Title, change["SourceTable"], change["RecordKey"])
+			finding := Record{
+				"RuleId":      rule.ID,
+				"Title":       rule.Title,
+				"Severity":    rule.Severity,
+				"Description": rule.Description,
+				"SourceTable": change["SourceTable"],
+				"ChangeType":  change["ChangeType"],
+				"RecordKey":   change["RecordKey"],
+				"Field":       change["Field"],
+				"OldValue":    change["OldValue"],
+				"NewValue":    change["NewValue"],
+				"ChangeTime":  change["ChangeTime"],
+			}
+			if actor, ok := change["ChangedBy"]; ok {
+				finding["ChangedBy"] = actor
+			}
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+func (r Rule) matches(change Record) bool {
+	changeType, _ := change["ChangeType"].(string)
+	if r.Table != "" && r.Table != change["SourceTable"] {
+		return false
+	}
+	if r.ChangeType != "" && !strings.EqualFold(r.ChangeType, changeType) {
+		return false
+	}
+
+	oldValue, newValue := change["OldValue"], change["NewValue"]
+	if r.Field != "" {
+		if changeType == "changed" {
+			field, _ := change["Field"].(string)
+			if ok, _ := path.Match(r.Field, field); !ok {
+				return false
+			}
+		} else {
+			var found bool
+			if oldValue, found = lookupField(oldValue, r.Field); !found && changeType == "removed" {
+				return false
+			}
+			if newValue, found = lookupField(newValue, r.Field); !found && changeType == "added" {
+				return false
+			}
+		}
+	}
+
+	return valueMatches(r.OldValue, oldValue) && valueMatches(r.NewValue, newValue)
+}
+
+// lookupField resolves a dotted field path inside a record.
+func lookupField(value interface{}, field string) (interface{}, bool) {
+	for _, name := range strings.Split(field, ".") {
+		m, ok := asMap(value)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func valueMatches(expected json.RawMessage, actual interface{}) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	var want interface{}
+	if err := json.Unmarshal(expected, &want); err != nil {
+		return false
+	}
+	if wantString, ok := want.(string); ok {
+		if actualString, ok := actual.(string); ok {
+			return strings.EqualFold(wantString, actualString)
+		}
+	}
+	return reflect.DeepEqual(want, actual)
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func ruleIDs(findings []Record) []string {
+	var ids []string
+	for _, finding := range findings {
+		ids = append(ids, finding["RuleId"].(string))
+	}
+	return ids
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		change Record
+		want   bool
+	}{
+		{
+			name:   "glob on a dotted field",
+			rule:   `{"field": "storageAccountProperties.*"}`,
+			change: Record{"ChangeType": "changed", "Field": "storageAccountProperties.storageAccountResourceId"},
+			want:   true,
+		},
+		{
+			name:   "glob on another field",
+			rule:   `{"field": "*.storageAccountName"}`,
+			change: Record{"ChangeType": "changed", "Field": "storageAccountProperties.storageAccountResourceId"},
+		},
+		{
+			name:   "field inside an added record",
+			rule:   `{"field": "settings.Scope", "newValue": "organization"}`,
+			change: Record{"ChangeType": "added", "NewValue": map[string]interface{}{"settings": map[string]interface{}{"Scope": "Organization"}}},
+			want:   true,
+		},
+		{
+			name:   "field missing from an added record",
+			rule:   `{"field": "Scope"}`,
+			change: Record{"ChangeType": "added", "NewValue": map[string]interface{}{"Name": "x"}},
+		},
+		{
+			name:   "field missing from a removed record",
+			rule:   `{"field": "Scope"}`,
+			change: Record{"ChangeType": "removed", "OldValue": map[string]interface{}{"Name": "x"}},
+		},
+		{
+			name:   "values not in the rule match anything",
+			rule:   `{"table": "MdeRoles", "changeType": "CHANGED"}`,
+			change: Record{"SourceTable": "MdeRoles", "ChangeType": "changed", "OldValue": 1.0, "NewValue": "x"},
+			want:   true,
+		},
+		{
+			name:   "new value differs",
+			rule:   `{"newValue": false}`,
+			change: Record{"ChangeType": "changed", "OldValue": false, "NewValue": true},
+		},
+		{
+			name:   "null old value is compared",
+			rule:   `{"oldValue": null}`,
+			change: Record{"ChangeType": "changed", "OldValue": "x", "NewValue": nil},
+		},
+		{
+			name:   "both values",
+			rule:   `{"oldValue": "Block", "newValue": "allowed"}`,
+			change: Record{"ChangeType": "changed", "OldValue": "block", "NewValue": "Allowed"},
+			want:   true,
+		},
+		{
+			name:   "other table",
+			rule:   `{"table": "MdeRoles"}`,
+			change: Record{"SourceTable": "MdeIndicators", "ChangeType": "added"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rule Rule
+			if err := json.Unmarshal([]byte(test.rule), &rule); err != nil {
+				t.Fatal(err)
+			}
+			if got := rule.matches(test.change); got != test.want {
+				t.Errorf("matches %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRulesOverrides(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	custom := `[
+		{"id": "DH-0016", "title": "Role added", "severity": "High", "table": "MdeRoles", "changeType": "added"},
+		{"id": "DH-0007", "disabled": true},
+		{"id": "CUSTOM-1", "title": "Role removed", "severity": "High", "table": "MdeRoles", "changeType": "removed"}
+	]`
+	if err := os.WriteFile(file, []byte(custom), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	shipped, err := LoadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadRules(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != len(shipped)+1 {
+		t.Fatalf("loaded %d rules, want the %d shipped rules and one custom rule", len(rules), len(shipped))
+	}
+
+	findings := EvaluateRules(rules, []Record{
+		{"SourceTable": "MdeRoles", "ChangeType": "added", "RecordKey": "Id=1"},
+		{"SourceTable": "MdeCustomDetectionState", "ChangeType": "removed", "RecordKey": "Id=2"},
+		{"SourceTable": "MdeRoles", "ChangeType": "removed", "RecordKey": "Id=3", "ChangedBy": "alice"},
+	})
+	if ids := ruleIDs(findings); len(ids) != 2 || ids[0] != "DH-0016" || ids[1] != "CUSTOM-1" {
+		t.Fatalf("findings of rules %v, want DH-0016 and CUSTOM-1", ids)
+	}
+	if findings[0]["Severity"] != "High" {
+		t.Errorf("overridden rule has severity %v, want High", findings[0]["Severity"])
+	}
+	if findings[1]["ChangedBy"] != "alice" || findings[1]["RecordKey"] != "Id=3" {
+		t.Errorf("finding %v does not carry the change", findings[1])
+	}
+}
+
+func TestShippedRules(t *testing.T) {
+	rules, err := LoadRules("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := func(table, field string, oldValue, newValue interface{}) Record {
+		return Record{"SourceTable": table, "ChangeType": "changed", "Field": field, "OldValue": oldValue, "NewValue": newValue}
+	}
+	added := func(table string, record map[string]interface{}) Record {
+		return Record{"SourceTable": table, "ChangeType": "added", "NewValue": record}
+	}
+	removed := func(table string, record map[string]interface{}) Record {
+		return Record{"SourceTable": table, "ChangeType": "removed", "OldValue": record}
+	}
+
+	tests := map[string]Record{
+		"DH-0001": changed("MdeAdvancedFeatureSettings", "EnableWdavAntiTampering", true, false),
+		"DH-0002": added("MdeSuppressionRules", map[string]interface{}{"Id": 1.0, "Scope": "Organization"}),
+		"DH-0003": changed("MdeSuppressionRules", "Scope", "MachineGroups", "Organization"),
+		"DH-0004": added("M365DataExportSettings", map[string]interface{}{"id": "export"}),
+		"DH-0005": changed("M365DataExportSettings", "storageAccountProperties.storageAccountResourceId", "/a", "/b"),
+		"DH-0006": changed("MdeCustomDetectionState", "IsEnabled", true, false),
+		"DH-0007": removed("MdeCustomDetectionState", map[string]interface{}{"Id": 1.0}),
+		"DH-0008": added("MdeLiveResponseLibrary", map[string]interface{}{"fileName": "run.ps1"}),
+		"DH-0009": changed("MdeLiveResponseLibrary", "sha256", "aa", "bb"),
+		"DH-0010": removed("MdeLiveResponseLibrary", map[string]interface{}{"fileName": "run.ps1"}),
+		"DH-0011": added("MdeIndicators", map[string]interface{}{"id": "1", "action": "Allowed"}),
+		"DH-0012": changed("MdeIndicators", "action", "Block", "Allowed"),
+		"DH-0013": removed("MdeIndicators", map[string]interface{}{"id": "1"}),
+		"DH-0014": changed("MdeRoles", "Permissions", []interface{}{"ViewData"}, []interface{}{"ViewData", "LiveResponseAdvanced"}),
+		"DH-0015": changed("MdeRoles", "AssignedUserGroups", []interface{}{"a"}, []interface{}{"a", "b"}),
+		"DH-0016": added("MdeRoles", map[string]interface{}{"Id": 1.0}),
+	}
+	if len(tests) != len(rules) {
+		t.Errorf("%d shipped rules, %d tested", len(rules), len(tests))
+	}
+	for id, change := range tests {
+		t.Run(id, func(t *testing.T) {
+			if ids := ruleIDs(EvaluateRules(rules, []Record{change})); len(ids) != 1 || ids[0] != id {
+				t.Errorf("change %v matched rules %v, want only %s", change, ids, id)
+			}
+		})
+	}
+
+	benign := []Record{
+		changed("MdeAdvancedFeatureSettings", "EnableWdavAntiTampering", false, true),
+		added("MdeSuppressionRules", map[string]interface{}{"Id": 2.0, "Scope": "MachineGroups"}),
+		changed("MdeCustomDetectionState", "IsEnabled", false, true),
+		added("MdeIndicators", map[string]interface{}{"id": "2", "action": "Block"}),
+	}
+	if ids := ruleIDs(EvaluateRules(rules, benign)); len(ids) != 0 {
+		t.Errorf("benign changes matched rules %v", ids)
+	}
+}
@@ -0,0 +1,323 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaColumn is a column of an advanced hunting table.
+type SchemaColumn struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// SchemaTable is an advanced hunting table.
+type SchemaTable struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Columns     []SchemaColumn `json:"columns"`
+}
+
+// SchemaSnapshot is a version of the schema reference kept in the state store.
+type SchemaSnapshot struct {
+	Version int           `json:"version"`
+	Time    time.Time     `json:"time"`
+	Hash    string        `json:"hash"`
+	Tables  []SchemaTable `json:"tables"`
+}
+
+// SchemaChange is a difference between two schema snapshots.
+type SchemaChange struct {
+	// Change is "table added", "table removed", "column added", "column
+	// removed" or "type changed".
+	Change  string `json:"change"`
+	Table   string `json:"table"`
+	Column  string `json:"column,omitempty"`
+	OldType string `json:"oldType,omitempty"`
+	NewType string `json:"newType,omitempty"`
+}
+
+const schemaVersionsName = "schema-versions"
+
+// GetSchemaReference retrieves the schema reference, stores it as a new
+// snapshot when it changed since the latest one, and delivers it to table.
+func GetSchemaReference(cfg Config, endpoint string, table string, location string) error {
+	resource := fmt.Sprintf("https://%s.securitycenter.windows.com", location)
+	body, err := fetchServiceAPI(cfg, resource+endpoint)
+	if err != nil {
+		return err
+	}
+	records, err := DecodeRecords(body)
+	if err != nil {
+		return err
+	}
+
+	if cfg.State != nil {
+		if err := storeSchemaVersion(cfg.State, ParseSchema(records), cfg.HarvestTime); err != nil {
+			return err
+		}
+	}
+
+	return deliver(cfg, table, location+".securitycenter.windows.com"+endpoint, records)
+}
+
+// storeSchemaVersion saves tables as a new schema version. A response none of
+// the tables could be parsed from is not stored, and tables without columns
+// are reported, since a diff would show them as having lost all their columns.
+func storeSchemaVersion(state *StateStore, tables []SchemaTable, t time.Time) error {
+	missing := tablesWithoutColumns(tables)
+	if len(missing) == len(tables) {
+		log.Println("No tables with columns found in the schema reference, not storing a schema version")
+		return nil
+	}
+	if len(missing) > 0 {
+		log.Printf("No columns found for %d tables: %s\n", len(missing), strings.Join(missing, ", "))
+	}
+
+	snapshot, stored, err := SaveSchemaSnapshot(state, tables, t)
+	if err != nil {
+		return err
+	}
+	if stored {
+		log.Printf("Stored schema version %d with %d tables\n", snapshot.Version, len(snapshot.Tables))
+	} else {
+		log.Printf("Schema unchanged since version %d\n", snapshot.Version)
+	}
+	return nil
+}
+
+// ParseSchema reads the tables and columns from the schema reference records,
+// which are either the tables or a single object listing them in Tables.
+func ParseSchema(records []Record) []SchemaTable {
+	if len(records) == 1 {
+		for _, field := range []string{"Tables", "tables"} {
+			list, ok := records[0][field].([]interface{})
+			if !ok {
+				continue
+			}
+			records = make([]Record, 0, len(list))
+			for _, item := range list {
+				if table, ok := item.(map[string]interface{}); ok {
+					records = append(records, table)
+				}
+			}
+			break
+		}
+	}
+
+	tables := make([]SchemaTable, 0, len(records))
+	for _, record := range records {
+		name := firstField(record, "Name", "name", "TableName", "tableName")
+		if name == "" {
+			continue
+		}
+		table := SchemaTable{Name: name, Description: firstField(record, "Description", "description")}
+		for _, field := range []string{"Columns", "columns", "Schema", "schema"} {
+			columns, ok := record[field].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, item := range columns {
+				column, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				table.Columns = append(table.Columns, SchemaColumn{
+					Name:        firstField(column, "Name", "name", "ColumnName", "columnName"),
+					Type:        firstField(column, "Type", "type", "ColumnType", "columnType", "DataType"),
+					Description: firstField(column, "Description", "description"),
+				})
+			}
+			break
+		}
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables
+}
+
+// tablesWithoutColumns returns the names of the tables no columns were parsed
+// for.
+func tablesWithoutColumns(tables []SchemaTable) []string {
+	var names []string
+	for _, table := range tables {
+		if len(table.Columns) == 0 {
+			names = append(names, table.Name)
+		}
+	}
+	return names
+}
+
+// SchemaVersions returns the stored schema versions, oldest first, without
+// their tables.
+func SchemaVersions(state *StateStore) ([]SchemaSnapshot, error) {
+	var versions []SchemaSnapshot
+	if _, err := state.Load(schemaVersionsName, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// SaveSchemaSnapshot stores tables as a new version, unless they are equal to
+// the latest version. It returns the latest version and whether it is new.
+func SaveSchemaSnapshot(state *StateStore, tables []SchemaTable, t time.Time) (SchemaSnapshot, bool, error) {
+	data, err := json.Marshal(tables)
+	if err != nil {
+		return SchemaSnapshot{}, false, fmt.Errorf("failed to encode schema: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	versions, err := SchemaVersions(state)
+	if err != nil {
+		return SchemaSnapshot{}, false, err
+	}
+	if n := len(versions); n > 0 && versions[n-1].Hash == hash {
+		latest := versions[n-1]
+		latest.Tables = tables
+		return latest, false, nil
+	}
+
+	snapshot := SchemaSnapshot{Version: len(versions) + 1, Time: t.UTC(), Hash: hash, Tables: tables}
+	if err := state.Save(fmt.Sprintf("schema-v%d", snapshot.Version), snapshot); err != nil {
+		return SchemaSnapshot{}, false, err
+	}
+	versions = append(versions, SchemaSnapshot{Version: snapshot.Version, Time: snapshot.Time, Hash: hash})
+	if err := state.Save(schemaVersionsName, versions); err != nil {
+		return SchemaSnapshot{}, false, err
+	}
+	return snapshot, true, nil
+}
+
+// LoadSchemaSnapshot returns a stored schema version, counting back from the
+// latest for zero and negative versions: 0 is the latest, -1 the one before.
+func LoadSchemaSnapshot(state *StateStore, version int) (SchemaSnapshot, error) {
+	versions, err := SchemaVersions(state)
+	if err != nil {
+		return SchemaSnapshot{}, err
+	}
+	if version <= 0 {
+		version += len(versions)
+	}
+	if version < 1 || version > len(versions) {
+		return SchemaSnapshot{}, fmt.Errorf("schema version %d not found, %d versions are stored", version, len(versions))
+	}
+
+	var snapshot SchemaSnapshot
+	found, err := state.Load(fmt.Sprintf("schema-v%d", version), &snapshot)
+	if err != nil {
+		return SchemaSnapshot{}, err
+	}
+	if !found {
+		return SchemaSnapshot{}, fmt.Errorf("schema version %d is missing from the state directory", version)
+	}
+	return snapshot, nil
+}
+
+// DiffSchemas returns the tables and columns added or removed and the column
+// types changed between two schemas.
+func DiffSchemas(old []SchemaTable, new []SchemaTable) []SchemaChange {
+	oldTables := make(map[string]SchemaTable, len(old))
+	for _, table := range old {
+		oldTables[table.Name] = table
+	}
+	newTables := make(map[string]SchemaTable, len(new))
+	for _, table := range new {
+		newTables[table.Name] = table
+	}
+
+	var changes []SchemaChange
+	for _, table := range old {
+		if _, ok := newTables[table.Name]; !ok {
+			changes = append(changes, SchemaChange{Change: "table removed", Table: table.Name})
+		}
+	}
+	for _, table := range new {
+		previous, ok := oldTables[table.Name]
+		if !ok {
+			changes = append(changes, SchemaChange{Change: "table added", Table: table.Name})
+			continue
+		}
+
+		oldColumns := make(map[string]SchemaColumn, len(previous.Columns))
+		for _, column := range previous.Columns {
+			oldColumns[column.Name] = column
+		}
+		newColumns := make(map[string]bool, len(table.Columns))
+		for _, column := range table.Columns {
+			newColumns[column.Name] = true
+			before, ok := oldColumns[column.Name]
+			switch {
+			case !ok:
+				changes = append(changes, SchemaChange{Change: "column added", Table: table.Name, Column: column.Name, NewType: column.Type})
+			case !strings.EqualFold(before.Type, column.Type):
+				changes = append(changes, SchemaChange{Change: "type changed", Table: table.Name, Column: column.Name, OldType: before.Type, NewType: column.Type})
+			}
+		}
+		for _, column := range previous.Columns {
+			if !newColumns[column.Name] {
+				changes = append(changes, SchemaChange{Change: "column removed", Table: table.Name, Column: column.Name, OldType: column.Type})
+			}
+		}
+	}
+	return changes
+}
+
+// RenderSchemaMarkdown writes a Markdown section with a column table per table.
+func RenderSchemaMarkdown(w io.Writer, tables []SchemaTable) {
+	cell := strings.NewReplacer("|", `\|`, "\n", " ")
+	for _, table := range tables {
+		fmt.Fprintf(w, "## %s\n\n", table.Name)
+		if table.Description != "" {
+			fmt.Fprintf(w, "%s\n\n", table.Description)
+		}
+		fmt.Fprintln(w, "| Column | Type | Description |")
+		fmt.Fprintln(w, "|---|---|---|")
+		for _, column := range table.Columns {
+			fmt.Fprintf(w, "| %s | %s | %s |\n", cell.Replace(column.Name), cell.Replace(column.Type), cell.Replace(column.Description))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// RenderSchemaKQL writes a .create table command per table.
+func RenderSchemaKQL(w io.Writer, tables []SchemaTable) {
+	for _, table := range tables {
+		columns := make([]string, 0, len(table.Columns))
+		for _, column := range table.Columns {
+			columns = append(columns, fmt.Sprintf("['%s']: %s", column.Name, kqlType(column.Type)))
+		}
+		fmt.Fprintf(w, ".create table ['%s'] (%s)\n", table.Name, strings.Join(columns, ", "))
+	}
+}
+
+// kqlType maps an advanced hunting column type onto its KQL scalar type.
+func kqlType(columnType string) string {
+	switch strings.ToLower(columnType) {
+	case "datetime", "date":
+		return "datetime"
+	case "int", "int32":
+		return "int"
+	case "long", "int64":
+		return "long"
+	case "bool", "boolean":
+		return "bool"
+	case "real", "double", "float", "decimal":
+		return "real"
+	case "guid", "uniqueid":
+		return "guid"
+	case "timespan":
+		return "timespan"
+	case "dynamic", "object", "array":
+		return "dynamic"
+	}
+	return "string"
+}
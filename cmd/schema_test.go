@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func loadSchemaFixture(t *testing.T) []Record {
+	t.Helper()
+	body, err := os.ReadFile("testdata/huntingservice_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := DecodeRecords(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestParseSchema(t *testing.T) {
+	tables := ParseSchema(loadSchemaFixture(t))
+
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name)
+	}
+	if want := []string{"AlertInfo", "DeviceInfo", "DeviceLogonEvents"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("tables = %v, want %v", names, want)
+	}
+	if missing := tablesWithoutColumns(tables); len(missing) > 0 {
+		t.Errorf("no columns parsed for %v", missing)
+	}
+
+	logons := tables[2]
+	if logons.Description != "Sign-ins and other authentication events on devices" {
+		t.Errorf("description = %q", logons.Description)
+	}
+	if len(logons.Columns) != 9 {
+		t.Fatalf("got %d DeviceLogonEvents columns, want 9", len(logons.Columns))
+	}
+	want := SchemaColumn{Name: "IsLocalAdmin", Type: "Boolean", Description: "Boolean indicator of whether the user is a local administrator on the device"}
+	if logons.Columns[6] != want {
+		t.Errorf("column = %+v, want %+v", logons.Columns[6], want)
+	}
+}
+
+func TestParseSchemaTableList(t *testing.T) {
+	var envelope struct {
+		Tables []Record
+	}
+	body, err := os.ReadFile("testdata/huntingservice_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	list, err := json.Marshal(envelope.Tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := DecodeRecords(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := ParseSchema(records), ParseSchema(loadSchemaFixture(t)); !reflect.DeepEqual(got, want) {
+		t.Errorf("a bare table list parses to %+v, want %+v", got, want)
+	}
+}
+
+func TestParseSchemaUnknownColumnKey(t *testing.T) {
+	tables := ParseSchema([]Record{
+		{"Name": "DeviceEvents", "Fields": []interface{}{map[string]interface{}{"Name": "Timestamp", "Type": "DateTime"}}},
+		{"Name": "DeviceInfo", "Columns": []interface{}{map[string]interface{}{"Name": "Timestamp", "Type": "DateTime"}}},
+	})
+	if missing := tablesWithoutColumns(tables); !reflect.DeepEqual(missing, []string{"DeviceEvents"}) {
+		t.Errorf("tables without columns = %v, want [DeviceEvents]", missing)
+	}
+}
+
+func TestStoreSchemaVersionSkipsUnparsedSchema(t *testing.T) {
+	state, err := NewStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unparsed := ParseSchema([]Record{{"Name": "DeviceEvents", "Fields": []interface{}{}}})
+	if err := storeSchemaVersion(state, unparsed, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := SchemaVersions(state); err != nil || len(versions) != 0 {
+		t.Fatalf("stored %d versions (%v), want none", len(versions), err)
+	}
+
+	if err := storeSchemaVersion(state, ParseSchema(loadSchemaFixture(t)), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := LoadSchemaSnapshot(state, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Version != 1 || len(snapshot.Tables) != 3 {
+		t.Errorf("stored version %d with %d tables, want version 1 with 3 tables", snapshot.Version, len(snapshot.Tables))
+	}
+}
+
+func TestDiffSchemas(t *testing.T) {
+	old := ParseSchema(loadSchemaFixture(t))
+	current := ParseSchema(loadSchemaFixture(t))
+
+	// AlertInfo loses AttackTechniques, DeviceInfo.AssetValue becomes a
+	// Long, DeviceLogonEvents is dropped and DeviceEvents added.
+	current[0].Columns = current[0].Columns[:4]
+	current[1].Columns[5].Type = "Long"
+	current[2] = SchemaTable{Name: "DeviceEvents", Columns: []SchemaColumn{{Name: "Timestamp", Type: "DateTime"}}}
+
+	want := []SchemaChange{
+		{Change: "table removed", Table: "DeviceLogonEvents"},
+		{Change: "column removed", Table: "AlertInfo", Column: "AttackTechniques", OldType: "String"},
+		{Change: "type changed", Table: "DeviceInfo", Column: "AssetValue", OldType: "Int", NewType: "Long"},
+		{Change: "table added", Table: "DeviceEvents"},
+	}
+	if got := DiffSchemas(old, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %+v\nwant %+v", got, want)
+	}
+}
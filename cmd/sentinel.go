@@ -5,6 +5,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -19,7 +20,7 @@ func SendToSentinel(QueryResults []byte, table string) error {
 	customerId := os.Getenv("SentinelWorkspaceID")
 	sharedKey := os.Getenv("SentinelSharedKey")
 	logName := table
-	timeStampField := "DateValue"
+	timeStampField := "TimeGenerated"
 
 	dateString := time.Now().UTC().Format(time.RFC1123)
 	dateString = strings.Replace(dateString, "UTC", "GMT", -1)
@@ -35,25 +36,28 @@ func SendToSentinel(QueryResults []byte, table string) error {
 	url := "https://" + customerId + ".ods.opinsights.azure.com/api/logs?api-version=2016-04-01"
 
 	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(QueryResults)))
-	if err != nil {
-		return err
-	}
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(QueryResults)))
+		if err != nil {
+			return nil, err
+		}
 
-	req.Header.Add("Log-Type", logName)
-	req.Header.Add("Authorization", signature)
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("x-ms-date", dateString)
-	req.Header.Add("time-generated-field", timeStampField)
+		req.Header.Add("Log-Type", logName)
+		req.Header.Add("Authorization", signature)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("x-ms-date", dateString)
+		req.Header.Add("time-generated-field", timeStampField)
+		return req, nil
+	}
 
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(client, newRequest)
 	if err != nil {
 		log.Println("Error sending data to Sentinel: ", err.Error())
 		return err
 	}
 	if resp.StatusCode != 200 {
-		log.Println("Error sending data to Sentinel: ", resp.Status)
-		return err
+		resp.Body.Close()
+		return fmt.Errorf("unexpected status from Sentinel: %s", resp.Status)
 	}
 
 	return resp.Body.Close()
@@ -35,16 +35,17 @@ func PostToSplunk(QueryResults []byte, table string) error {
 		return err
 	}
 
-	// Create HTTP request
-	req, err := http.NewRequest("POST", SplunkUri, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
+	// Create HTTP request, built again for every retry
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", SplunkUri, bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Splunk %s", SplunkToken))
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
 	}
 
-	// Set headers
-	req.Header.Set("Authorization", fmt.Sprintf("Splunk %s", SplunkToken))
-	req.Header.Set("Content-Type", "application/json")
-
 	// Create HTTP client with custom transport to disable SSL verification
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -52,7 +53,7 @@ func PostToSplunk(QueryResults []byte, table string) error {
 	client := &http.Client{Transport: tr}
 
 	// Send HTTP request
-	resp, err := client.Do(req)
+	resp, err := doWithRetry(client, newRequest)
 	if err != nil {
 		return err
 	}
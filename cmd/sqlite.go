@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteColumns are extracted from every record next to the JSON Data column.
+var sqliteColumns = []string{"TimeGenerated", "HarvestTime", "TenantId", "MachineId"}
+
+var sqliteIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	if _, err := db.Exec("PRAGMA journal_mode=WAL; PRAGMA busy_timeout=5000"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// SaveToSQLite stores records in a table named after the collector, with the
+// record as JSON in the Data column and the key fields extracted into their
+// own columns. Records are deduplicated on their RecordId.
+func SaveToSQLite(records []Record, table string, path string) error {
+	if !sqliteIdentifier.MatchString(table) {
+		return fmt.Errorf("invalid table name %q", table)
+	}
+
+	db, err := openSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	columns := append([]string{}, sqliteColumns...)
+	for _, field := range collectorFor(table).KeyFields {
+		if sqliteIdentifier.MatchString(field) && !containsFold(columns, field) && !strings.EqualFold(field, "RecordId") && !strings.EqualFold(field, "Data") {
+			columns = append(columns, field)
+		}
+	}
+	if err := ensureSQLiteTable(db, table, columns); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)+2), ", ")
+	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT OR IGNORE INTO "%s" ("RecordId", "Data", "%s") VALUES (%s)`,
+		table, strings.Join(columns, `", "`), placeholders))
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	var inserted int64
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		args := []interface{}{fieldString(record, "RecordId"), string(data)}
+		for _, column := range columns {
+			if value := fieldString(record, column); value != "" {
+				args = append(args, value)
+			} else {
+				args = append(args, nil)
+			}
+		}
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert record: %w", err)
+		}
+		n, _ := result.RowsAffected()
+		inserted += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit records: %w", err)
+	}
+	log.Printf("↳ Stored %d new %s records in %s\n", inserted, table, path)
+	return nil
+}
+
+// ensureSQLiteTable creates the collector table, adding columns that were
+// introduced after it was created.
+func ensureSQLiteTable(db *sql.DB, table string, columns []string) error {
+	definitions := []string{`"RecordId" TEXT PRIMARY KEY`, `"Data" TEXT NOT NULL`}
+	for _, column := range columns {
+		definitions = append(definitions, fmt.Sprintf(`"%s" TEXT`, column))
+	}
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS "%s" (%s)`, table, strings.Join(definitions, ", "))); err != nil {
+		return fmt.Errorf("failed to create table %s: %w", table, err)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`PRAGMA table_info("%s")`, table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %w", table, err)
+	}
+	var existing []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing = append(existing, name)
+	}
+	rows.Close()
+
+	for _, column := range columns {
+		if containsFold(existing, column) {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN "%s" TEXT`, table, column)); err != nil {
+			return fmt.Errorf("failed to add column %s to %s: %w", column, table, err)
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "%s_TimeGenerated" ON "%s" ("TimeGenerated")`, table, table))
+	return err
+}
+
+func containsFold(list []string, item string) bool {
+	for _, entry := range list {
+		if strings.EqualFold(entry, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuerySQLite runs query against the database at path and prints the result
+// as an aligned table or as a JSON array.
+func QuerySQLite(path string, query string, output string, w io.Writer) error {
+	db, err := openSQLite("file:" + path + "?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	var results []Record
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		result := make(Record, len(columns))
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			result[column] = values[i]
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if results == nil {
+			results = []Record{}
+		}
+		return encoder.Encode(results)
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(columns, "\t"))
+		for _, result := range results {
+			cells := make([]string, len(columns))
+			for i, column := range columns {
+				if result[column] != nil {
+					cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(fmt.Sprint(result[column]))
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unsupported output %q, use table or json", output)
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func machineActions(statuses ...string) []Record {
+	records := make([]Record, 0, len(statuses))
+	for i, status := range statuses {
+		records = append(records, Record{
+			"ActionId":       "a1",
+			"ActionStatus":   status,
+			"LastUpdateTime": fmt.Sprintf("2024-03-05T10:00:%02dZ", i),
+			"MachineId":      "m1",
+			"TimeGenerated":  "2024-03-05T10:00:00Z",
+		})
+	}
+	AssignRecordIDs("MdeMachineActions", records)
+	return records
+}
+
+func querySQLite(t *testing.T, path string, query string) []Record {
+	t.Helper()
+	var out bytes.Buffer
+	if err := QuerySQLite(path, query, "json", &out); err != nil {
+		t.Fatal(err)
+	}
+	var results []Record
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("invalid JSON output %q: %v", out.String(), err)
+	}
+	return results
+}
+
+func TestSaveToSQLiteDedupes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defenderharvester.db")
+	if err := SaveToSQLite(machineActions("Pending", "InProgress"), "MdeMachineActions", path); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveToSQLite(machineActions("Pending", "InProgress", "Succeeded"), "MdeMachineActions", path); err != nil {
+		t.Fatal(err)
+	}
+
+	results := querySQLite(t, path, `SELECT ActionStatus FROM MdeMachineActions ORDER BY LastUpdateTime`)
+	var statuses []string
+	for _, result := range results {
+		statuses = append(statuses, result["ActionStatus"].(string))
+	}
+	if !reflect.DeepEqual(statuses, []string{"Pending", "InProgress", "Succeeded"}) {
+		t.Errorf("stored statuses %v, want every status once", statuses)
+	}
+}
+
+func TestSaveToSQLiteColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defenderharvester.db")
+	records := machineActions("Succeeded")
+	if err := SaveToSQLite(records, "MdeMachineActions", path); err != nil {
+		t.Fatal(err)
+	}
+
+	var columns []string
+	for _, result := range querySQLite(t, path, `SELECT name FROM pragma_table_info('MdeMachineActions')`) {
+		columns = append(columns, result["name"].(string))
+	}
+	want := []string{"RecordId", "Data", "TimeGenerated", "HarvestTime", "TenantId", "MachineId", "ActionId", "ActionStatus", "LastUpdateTime"}
+	if !reflect.DeepEqual(columns, want) {
+		t.Errorf("columns %v, want %v", columns, want)
+	}
+
+	results := querySQLite(t, path, `SELECT RecordId, ActionId, MachineId, TenantId, json_extract(Data, '$.ActionStatus') AS Status FROM MdeMachineActions`)
+	if len(results) != 1 {
+		t.Fatalf("%d rows, want 1", len(results))
+	}
+	row := results[0]
+	if row["RecordId"] != records[0]["RecordId"] || row["ActionId"] != "a1" || row["MachineId"] != "m1" || row["TenantId"] != nil || row["Status"] != "Succeeded" {
+		t.Errorf("row %v", row)
+	}
+
+	if err := SaveToSQLite(records, "Mde-Timeline", path); err == nil {
+		t.Error("an invalid table name was accepted")
+	}
+}
+
+func TestQuerySQLiteIsReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defenderharvester.db")
+	if err := SaveToSQLite(machineActions("Succeeded"), "MdeMachineActions", path); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		`DELETE FROM MdeMachineActions`,
+		`INSERT INTO MdeMachineActions (RecordId, Data) VALUES ('x', '{}')`,
+		`DROP TABLE MdeMachineActions`,
+		`CREATE TABLE Other (Id TEXT)`,
+	} {
+		var out bytes.Buffer
+		if err := QuerySQLite(path, query, "table", &out); err == nil {
+			t.Errorf("%s was not rejected", query)
+		}
+	}
+	if results := querySQLite(t, path, `SELECT count(*) AS n FROM MdeMachineActions`); results[0]["n"] != float64(1) {
+		t.Errorf("the database changed: %v", results)
+	}
+}
+
+func TestQuerySQLiteTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defenderharvester.db")
+	if err := SaveToSQLite(machineActions("Succeeded"), "MdeMachineActions", path); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := QuerySQLite(path, `SELECT ActionId, ActionStatus, TenantId FROM MdeMachineActions`, "table", &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || strings.Fields(lines[0])[1] != "ActionStatus" || strings.Join(strings.Fields(lines[1]), " ") != "a1 Succeeded" {
+		t.Errorf("table output %q", out.String())
+	}
+
+	if err := QuerySQLite(path, `SELECT 1`, "xml", &out); err == nil {
+		t.Error("an unsupported output was accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// StateStore persists small JSON documents between runs, one file per name.
+type StateStore struct {
+	Dir string
+}
+
+var unsafeStateChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// NewStateStore opens the state store in dir, creating it when needed.
+func NewStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return &StateStore{Dir: dir}, nil
+}
+
+// DefaultStateDir returns the per-user state directory.
+func DefaultStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".defenderharvester"
+	}
+	return filepath.Join(dir, "defenderharvester")
+}
+
+func (s *StateStore) path(name string) string {
+	return filepath.Join(s.Dir, unsafeStateChars.ReplaceAllString(name, "_")+".json")
+}
+
+// Load reads the document stored under name into v. It reports false when
+// nothing has been stored yet.
+func (s *StateStore) Load(name string, v interface{}) (bool, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read state %s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to decode state %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// Save stores v under name, replacing the previous document atomically.
+func (s *StateStore) Save(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode state %s: %w", name, err)
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, ".state-*")
+	if err != nil {
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state %s: %w", name, err)
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
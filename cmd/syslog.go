@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//go:embed syslog_mappings.json
+var defaultSyslogMappings []byte
+
+const (
+	syslogVendor  = "DefenderHarvester"
+	syslogProduct = "DefenderHarvester"
+	// syslogFacility is local0.
+	syslogFacility = 16
+	syslogTimeout  = 10 * time.Second
+	// syslogTimeLayout is the RFC 5424 TIMESTAMP, which allows at most six
+	// fractional digits.
+	syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+	// syslogMaxUDPBytes is the longest message sent over UDP, the limit of
+	// common receivers such as rsyslog and syslog-ng.
+	syslogMaxUDPBytes = 8192
+	syslogTruncated   = "...[truncated]"
+)
+
+// syslogMapping renders the records of one table as CEF or LEEF. All values
+// are record field names.
+type syslogMapping struct {
+	// Name is the field holding the event name, the table name by default.
+	Name string `json:"name"`
+	// EventID is the field holding the CEF signature id or LEEF event id.
+	EventID string `json:"eventId"`
+	// Severity is the field holding a Low/Medium/High/Critical severity.
+	Severity string `json:"severity"`
+	// CEF and LEEF map extension keys (e.g. act, suser) to record fields.
+	CEF  map[string]string `json:"cef"`
+	LEEF map[string]string `json:"leef"`
+}
+
+// syslogSeverities maps severities onto CEF severity and syslog severity.
+var syslogSeverities = map[string][2]int{
+	"informational": {1, 6},
+	"low":           {3, 5},
+	"medium":        {5, 4},
+	"high":          {8, 3},
+	"critical":      {10, 2},
+}
+
+// SendToSyslog sends records to a syslog receiver as RFC 5424 messages over
+// UDP, TCP or TLS. The message is the raw JSON record, or a CEF or LEEF event
+// rendered through the per-table field mappings.
+func SendToSyslog(records []Record, table string) error {
+	address := os.Getenv("SyslogAddress")
+	if address == "" {
+		return fmt.Errorf("SyslogAddress is not set")
+	}
+	protocol := strings.ToLower(os.Getenv("SyslogProtocol"))
+	if protocol == "" {
+		protocol = "udp"
+	}
+	format := strings.ToLower(os.Getenv("SyslogFormat"))
+	if format == "" {
+		format = "json"
+	}
+
+	mappings, err := loadSyslogMappings(os.Getenv("SyslogMappings"))
+	if err != nil {
+		return err
+	}
+	mapping := mappings[table]
+
+	var conn net.Conn
+	switch protocol {
+	case "udp", "tcp":
+		conn, err = net.DialTimeout(protocol, address, syslogTimeout)
+	case "tls":
+		dialer := &net.Dialer{Timeout: syslogTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+			InsecureSkipVerify: os.Getenv("SyslogInsecure") == "true",
+		})
+	default:
+		return fmt.Errorf("unsupported SyslogProtocol %q, use udp, tcp or tls", protocol)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	log.Println("↳ Sending data to syslog for table:", table)
+	var truncated int
+	defer func() {
+		if truncated > 0 {
+			log.Printf("Truncated %d %s messages to %d bytes, use SyslogProtocol tcp or tls to send them whole\n", truncated, table, syslogMaxUDPBytes)
+		}
+	}()
+	for _, record := range records {
+		var msg string
+		switch format {
+		case "json":
+			data, err := json.Marshal(record)
+			if err != nil {
+				return fmt.Errorf("failed to marshal record: %w", err)
+			}
+			msg = string(data)
+		case "cef":
+			msg = renderCEF(record, table, mapping)
+		case "leef":
+			msg = renderLEEF(record, table, mapping)
+		default:
+			return fmt.Errorf("unsupported SyslogFormat %q, use json, cef or leef", format)
+		}
+
+		severity := syslogSeverity(record, mapping)
+		line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+			syslogFacility*8+severity[1],
+			recordTimeGenerated(record).UTC().Format(syslogTimeLayout),
+			hostname,
+			"defenderharvester",
+			os.Getpid(),
+			syslogMsgID(table),
+			msg)
+
+		// Stream transports use octet counting framing (RFC 6587). A UDP
+		// datagram is one message, so longer messages are cut off.
+		if protocol != "udp" {
+			line = fmt.Sprintf("%d %s", len(line), line)
+		} else if len(line) > syslogMaxUDPBytes {
+			line = truncateSyslog(line, syslogMaxUDPBytes)
+			truncated++
+		}
+		conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return fmt.Errorf("failed to write to %s: %w", address, err)
+		}
+	}
+	return nil
+}
+
+// truncateSyslog cuts line to at most max bytes, without splitting a UTF-8
+// character, and marks it as truncated.
+func truncateSyslog(line string, max int) string {
+	end := max - len(syslogTruncated)
+	for end > 0 && !utf8.RuneStart(line[end]) {
+		end--
+	}
+	return line[:end] + syslogTruncated
+}
+
+// loadSyslogMappings returns the shipped mappings, with the tables in file
+// replacing the shipped ones.
+func loadSyslogMappings(file string) (map[string]syslogMapping, error) {
+	mappings := make(map[string]syslogMapping)
+	if err := json.Unmarshal(defaultSyslogMappings, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to parse shipped syslog mappings: %w", err)
+	}
+	if file == "" {
+		return mappings, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read syslog mappings: %w", err)
+	}
+	custom := make(map[string]syslogMapping)
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("failed to parse syslog mappings %s: %w", file, err)
+	}
+	for table, mapping := range custom {
+		mappings[table] = mapping
+	}
+	return mappings, nil
+}
+
+// syslogMsgID returns the table as a valid RFC 5424 MSGID.
+func syslogMsgID(table string) string {
+	if len(table) > 32 {
+		return table[:32]
+	}
+	return table
+}
+
+func syslogSeverity(record Record, mapping syslogMapping) [2]int {
+	if mapping.Severity != "" {
+		if severity, ok := syslogSeverities[strings.ToLower(fieldString(record, mapping.Severity))]; ok {
+			return severity
+		}
+	}
+	return syslogSeverities["low"]
+}
+
+// fieldString returns a record field rendered as text.
+func fieldString(record Record, field string) string {
+	value, ok := record[field]
+	if !ok || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
+
+func eventName(record Record, table string, mapping syslogMapping) (string, string) {
+	name, id := table, table
+	if mapping.Name != "" {
+		if value := fieldString(record, mapping.Name); value != "" {
+			name = value
+		}
+	}
+	if mapping.EventID != "" {
+		if value := fieldString(record, mapping.EventID); value != "" {
+			id = value
+		}
+	}
+	return name, id
+}
+
+// sortedKeys returns the keys of an extension mapping in a stable order.
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefEscaper         = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ", "|", "/")
+)
+
+func renderCEF(record Record, table string, mapping syslogMapping) string {
+	name, id := eventName(record, table, mapping)
+
+	extension := []string{
+		"rt=" + fmt.Sprint(recordTimeGenerated(record).UnixMilli()),
+		"cs1Label=Table",
+		"cs1=" + cefExtensionEscaper.Replace(table),
+	}
+	if recordID := fieldString(record, "RecordId"); recordID != "" {
+		extension = append(extension, "externalId="+recordID)
+	}
+	for _, key := range sortedKeys(mapping.CEF) {
+		if value := fieldString(record, mapping.CEF[key]); value != "" {
+			extension = append(extension, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+
+	return fmt.Sprintf("CEF:0|%s|%s|%s|%s|%s|%d|%s",
+		syslogVendor,
+		syslogProduct,
+		cefHeaderEscaper.Replace(fieldString(record, "HarvesterVersion")),
+		cefHeaderEscaper.Replace(id),
+		cefHeaderEscaper.Replace(name),
+		syslogSeverity(record, mapping)[0],
+		strings.Join(extension, " "))
+}
+
+func renderLEEF(record Record, table string, mapping syslogMapping) string {
+	_, id := eventName(record, table, mapping)
+
+	attributes := []string{
+		"devTime=" + recordTimeGenerated(record).Format("Jan 02 2006 15:04:05.000 MST"),
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"sev=" + fmt.Sprint(syslogSeverity(record, mapping)[0]),
+		"cat=" + leefEscaper.Replace(table),
+	}
+	if recordID := fieldString(record, "RecordId"); recordID != "" {
+		attributes = append(attributes, "externalId="+recordID)
+	}
+	for _, key := range sortedKeys(mapping.LEEF) {
+		if value := fieldString(record, mapping.LEEF[key]); value != "" {
+			attributes = append(attributes, key+"="+leefEscaper.Replace(value))
+		}
+	}
+
+	return fmt.Sprintf("LEEF:2.0|%s|%s|%s|%s|x09|%s",
+		syslogVendor,
+		syslogProduct,
+		leefEscaper.Replace(fieldString(record, "HarvesterVersion")),
+		leefEscaper.Replace(id),
+		strings.Join(attributes, "\t"))
+}
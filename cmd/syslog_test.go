@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRenderCEFEscaping(t *testing.T) {
+	mappings, err := loadSyslogMappings("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := Record{
+		"RecordId":      "r1",
+		"TimeGenerated": "2024-03-05T10:00:00Z",
+		"ActionType":    `Isolate|Full\Device`,
+		"Initiator":     "admin=root\\ops\nline2\r",
+	}
+
+	got := renderCEF(record, "MdeMachineActions", mappings["MdeMachineActions"])
+	want := `CEF:0|DefenderHarvester|DefenderHarvester||Isolate\|Full\\Device|Isolate\|Full\\Device|3|` +
+		`rt=1709632800000 cs1Label=Table cs1=MdeMachineActions externalId=r1 ` +
+		`act=Isolate|Full\\Device suser=admin\=root\\ops\nline2\r`
+	if got != want {
+		t.Errorf("CEF\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRenderLEEFEscaping(t *testing.T) {
+	mappings, err := loadSyslogMappings("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := Record{
+		"RecordId":      "r1",
+		"TimeGenerated": "2024-03-05T10:00:00Z",
+		"ActionType":    "Isolate|Full",
+		"Initiator":     "admin\tops\nline2",
+	}
+
+	got := renderLEEF(record, "MdeMachineActions", mappings["MdeMachineActions"])
+	header := "LEEF:2.0|DefenderHarvester|DefenderHarvester||Isolate/Full|x09|"
+	if !strings.HasPrefix(got, header) {
+		t.Fatalf("LEEF header of %q, want %q", got, header)
+	}
+	attributes := strings.Split(strings.TrimPrefix(got, header), "\t")
+	want := []string{
+		"devTime=Mar 05 2024 10:00:00.000 UTC",
+		"devTimeFormat=MMM dd yyyy HH:mm:ss.SSS z",
+		"sev=3",
+		"cat=MdeMachineActions",
+		"externalId=r1",
+		"action=Isolate/Full",
+		"usrName=admin ops line2",
+	}
+	if strings.Join(attributes, "\n") != strings.Join(want, "\n") {
+		t.Errorf("LEEF attributes\n%q\nwant\n%q", attributes, want)
+	}
+}
+
+func TestShippedSyslogMappings(t *testing.T) {
+	mappings, err := loadSyslogMappings("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for table, mapping := range mappings {
+		t.Run(table, func(t *testing.T) {
+			record := Record{"TimeGenerated": "2024-03-05T10:00:00Z"}
+			for _, fields := range []map[string]string{mapping.CEF, mapping.LEEF} {
+				for _, field := range fields {
+					record[field] = "value-" + field
+				}
+			}
+			for _, field := range []string{mapping.Name, mapping.EventID} {
+				if field != "" {
+					record[field] = "value-" + field
+				}
+			}
+			if mapping.Severity != "" {
+				record[mapping.Severity] = "High"
+			}
+
+			cef := renderCEF(record, table, mapping)
+			for key, field := range mapping.CEF {
+				if !strings.Contains(cef, " "+key+"=value-"+field) {
+					t.Errorf("CEF %q does not map %s to %s", cef, field, key)
+				}
+			}
+			leef := renderLEEF(record, table, mapping)
+			for key, field := range mapping.LEEF {
+				if !strings.Contains(leef, "\t"+key+"=value-"+field) {
+					t.Errorf("LEEF %q does not map %s to %s", leef, field, key)
+				}
+			}
+
+			header := strings.Split(cef, "|")
+			if mapping.Name != "" && header[5] != "value-"+mapping.Name {
+				t.Errorf("CEF name %q, want the %s field", header[5], mapping.Name)
+			}
+			if mapping.EventID != "" && header[4] != "value-"+mapping.EventID {
+				t.Errorf("CEF signature id %q, want the %s field", header[4], mapping.EventID)
+			}
+			if mapping.Severity != "" && header[6] != "8" {
+				t.Errorf("CEF severity %q, want 8 for High", header[6])
+			}
+		})
+	}
+}
+
+func TestTruncateSyslog(t *testing.T) {
+	line := strings.Repeat("é", 20)
+	for max := len(syslogTruncated); max <= len(line); max++ {
+		got := truncateSyslog(line, max)
+		if len(got) > max || !utf8.ValidString(got) || !strings.HasSuffix(got, syslogTruncated) {
+			t.Fatalf("truncated to %d bytes: %q", max, got)
+		}
+	}
+}
+
+var syslogHeaderPattern = regexp.MustCompile(`^<133>1 2024-03-05T10:00:00\.000000Z \S+ defenderharvester \d+ MdeTimeline - `)
+
+func TestSendToSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("SyslogAddress", conn.LocalAddr().String())
+	t.Setenv("SyslogProtocol", "udp")
+	t.Setenv("SyslogFormat", "json")
+	t.Setenv("SyslogMappings", "")
+
+	records := []Record{
+		{"TimeGenerated": "2024-03-05T10:00:00Z", "ActionType": "ProcessCreated"},
+		{"TimeGenerated": "2024-03-05T10:00:00Z", "CommandLine": strings.Repeat("x", 2*syslogMaxUDPBytes)},
+	}
+	if err := SendToSyslog(records, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4*syslogMaxUDPBytes)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !syslogHeaderPattern.MatchString(msg) || !strings.HasSuffix(msg, `{"ActionType":"ProcessCreated","TimeGenerated":"2024-03-05T10:00:00Z"}`) {
+		t.Errorf("message %q", msg)
+	}
+	n, _, err = conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); n != syslogMaxUDPBytes || !strings.HasSuffix(msg, syslogTruncated) {
+		t.Errorf("large message of %d bytes ending in %q, want %d bytes ending in %q", n, msg[len(msg)-20:], syslogMaxUDPBytes, syslogTruncated)
+	}
+}
+
+func TestSendToSyslogTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	t.Setenv("SyslogAddress", listener.Addr().String())
+	t.Setenv("SyslogProtocol", "tcp")
+	t.Setenv("SyslogFormat", "json")
+	t.Setenv("SyslogMappings", "")
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		var messages []string
+		reader := bufio.NewReader(conn)
+		for {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				break
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(length))
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				break
+			}
+			messages = append(messages, string(msg))
+		}
+		received <- messages
+	}()
+
+	large := strings.Repeat("x", 2*syslogMaxUDPBytes)
+	records := []Record{
+		{"TimeGenerated": "2024-03-05T10:00:00Z", "CommandLine": large},
+		{"TimeGenerated": "2024-03-05T10:00:00Z", "ActionType": "ProcessCreated"},
+	}
+	if err := SendToSyslog(records, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+
+	messages := <-received
+	if len(messages) != 2 {
+		t.Fatalf("received %d messages, want 2", len(messages))
+	}
+	for i, msg := range messages {
+		if !syslogHeaderPattern.MatchString(msg) {
+			t.Errorf("message %d has header %q", i, msg[:60])
+		}
+	}
+	if !strings.HasSuffix(messages[0], fmt.Sprintf(`{"CommandLine":"%s","TimeGenerated":"2024-03-05T10:00:00Z"}`, large)) {
+		t.Error("large message was not sent whole over tcp")
+	}
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Webhook posts the records of a table that pass its filter to a URL.
+type Webhook struct {
+	URL string `json:"url"`
+	// Table selects the records, an empty table matches every table.
+	Table string `json:"table"`
+	// Filter is a text/template that must render "true" for a record to be
+	// posted, e.g. {{ eq .type "LiveResponse" }}.
+	Filter string `json:"filter"`
+	// Template renders the payload of a record, the record as JSON by default.
+	Template     string            `json:"template"`
+	TemplateFile string            `json:"templateFile"`
+	ContentType  string            `json:"contentType"`
+	Headers      map[string]string `json:"headers"`
+	// SecretEnv names the environment variable holding the HMAC key. When
+	// set the request is signed in the X-DefenderHarvester-Signature header.
+	SecretEnv string `json:"secretEnv"`
+
+	filter  *template.Template
+	payload *template.Template
+	secret  []byte
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// LoadWebhooks reads the webhooks configured in file, with their templates
+// parsed and their HMAC keys read, so they are ready to post for every table
+// of the run.
+func LoadWebhooks(file string) ([]Webhook, error) {
+	if file == "" {
+		return nil, fmt.Errorf("WebhookConfig is not set")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook config: %w", err)
+	}
+	var webhooks []Webhook
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook config %s: %w", file, err)
+	}
+	for i := range webhooks {
+		if err := webhooks[i].prepare(); err != nil {
+			return nil, fmt.Errorf("webhook %s: %w", webhookHost(webhooks[i].URL), err)
+		}
+	}
+	return webhooks, nil
+}
+
+func (w *Webhook) prepare() error {
+	var err error
+	if w.Filter != "" {
+		if w.filter, err = template.New("filter").Funcs(webhookFuncs).Parse(w.Filter); err != nil {
+			return fmt.Errorf("failed to parse filter: %w", err)
+		}
+	}
+	if w.TemplateFile != "" {
+		data, err := os.ReadFile(w.TemplateFile)
+		if err != nil {
+			return fmt.Errorf("failed to read template: %w", err)
+		}
+		w.Template = string(data)
+	}
+	if w.Template != "" {
+		if w.payload, err = template.New("payload").Funcs(webhookFuncs).Parse(w.Template); err != nil {
+			return fmt.Errorf("failed to parse template: %w", err)
+		}
+	}
+	if w.ContentType == "" {
+		w.ContentType = "application/json"
+	}
+	if w.SecretEnv != "" {
+		if w.secret = []byte(os.Getenv(w.SecretEnv)); len(w.secret) == 0 {
+			return fmt.Errorf("secretEnv %s is empty, set it or remove secretEnv to send unsigned requests", w.SecretEnv)
+		}
+	}
+	return nil
+}
+
+// SendToWebhooks posts the records of table to the webhooks, one request per
+// record.
+func SendToWebhooks(webhooks []Webhook, records []Record, table string) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, webhook := range webhooks {
+		if webhook.Table != "" && webhook.Table != table {
+			continue
+		}
+		if err := webhook.send(client, records, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matches reports whether record passes the filter. A filter that fails on a
+// record, e.g. comparing a missing field, does not match it.
+func (w Webhook) matches(record Record) (bool, error) {
+	if w.filter == nil {
+		return true, nil
+	}
+	var result bytes.Buffer
+	if err := w.filter.Execute(&result, record); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(result.String()) == "true", nil
+}
+
+// render returns the payload posted for record.
+func (w Webhook) render(record Record) ([]byte, error) {
+	if w.payload == nil {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal record: %w", err)
+		}
+		return data, nil
+	}
+	var rendered bytes.Buffer
+	if err := w.payload.Execute(&rendered, record); err != nil {
+		return nil, fmt.Errorf("failed to render webhook payload: %w", err)
+	}
+	return rendered.Bytes(), nil
+}
+
+func (w Webhook) send(client *http.Client, records []Record, table string) error {
+	var posted, failed int
+	var filterErr error
+	for _, record := range records {
+		match, err := w.matches(record)
+		if err != nil {
+			failed++
+			filterErr = err
+		}
+		if !match {
+			continue
+		}
+
+		body, err := w.render(record)
+		if err != nil {
+			return err
+		}
+
+		resp, err := doWithRetry(client, func() (*http.Request, error) {
+			req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", w.ContentType)
+			req.Header.Set("X-DefenderHarvester-Table", table)
+			for name, value := range w.Headers {
+				req.Header.Set(name, os.ExpandEnv(value))
+			}
+			if len(w.secret) > 0 {
+				timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+				req.Header.Set("X-DefenderHarvester-Timestamp", timestamp)
+				req.Header.Set("X-DefenderHarvester-Signature", "sha256="+signWebhook(w.secret, timestamp, body))
+			}
+			return req, nil
+		})
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook %s returned status code %s", webhookHost(w.URL), resp.Status)
+		}
+		posted++
+	}
+
+	if failed > 0 {
+		log.Printf("The filter of webhook %s failed on %d %s records, which are not posted: %v\n", webhookHost(w.URL), failed, table, filterErr)
+	}
+	if posted > 0 {
+		log.Printf("↳ Posted %d %s records to webhook %s\n", posted, table, webhookHost(w.URL))
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.body", so receivers
+// can reject replayed requests.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookHost strips the path and query of a webhook URL, which often hold
+// secrets, for logging.
+func webhookHost(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		if j := strings.Index(url[i+3:], "/"); j >= 0 {
+			return url[:i+3+j]
+		}
+	}
+	return url
+}
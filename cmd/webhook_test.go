@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webhookRequest is a request received by the stand-in webhook receiver.
+type webhookRequest struct {
+	Header http.Header
+	Body   string
+}
+
+func newWebhookServer(t *testing.T) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	var requests []webhookRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, webhookRequest{Header: r.Header.Clone(), Body: string(body)})
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(s.Close)
+	return s, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+// writeWebhookConfig writes config to a temporary WebhookConfig file.
+func writeWebhookConfig(t *testing.T, config string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "webhooks.json")
+	if err := os.WriteFile(file, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestWebhookFilterAndTemplate(t *testing.T) {
+	s, requests := newWebhookServer(t)
+	dir := t.TempDir()
+	templateFile := filepath.Join(dir, "payload.tmpl")
+	if err := os.WriteFile(templateFile, []byte(`{"text": {{ json (printf "%s on %s" .type (upper .computerDnsName)) }}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SoarApiKey", "key-1")
+	webhooks, err := LoadWebhooks(writeWebhookConfig(t, `[
+		{"url": "`+s.URL+`/hook", "table": "MdeMachineActionsApi", "filter": "{{ eq .type \"LiveResponse\" }}",
+		 "templateFile": `+jsonString(templateFile)+`, "headers": {"X-Api-Key": "${SoarApiKey}"}},
+		{"url": "`+s.URL+`/other", "table": "MdeTimeline"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The template is read once when loading.
+	os.Remove(templateFile)
+
+	records := []Record{
+		{"type": "LiveResponse", "computerDnsName": "host-1"},
+		{"type": "Isolate", "computerDnsName": "host-2"},
+		{"computerDnsName": "host-3"},
+		{"type": 5, "computerDnsName": "host-4"},
+	}
+	if err := SendToWebhooks(webhooks, records, "MdeMachineActionsApi"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("posted %d requests, want 1", len(got))
+	}
+	if got[0].Body != `{"text": "LiveResponse on HOST-1"}` {
+		t.Errorf("payload %s", got[0].Body)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":                  "application/json",
+		"X-Api-Key":                     "key-1",
+		"X-Defenderharvester-Table":     "MdeMachineActionsApi",
+		"X-Defenderharvester-Signature": "",
+	} {
+		if value := got[0].Header.Get(name); value != want {
+			t.Errorf("header %s is %q, want %q", name, value, want)
+		}
+	}
+}
+
+func TestWebhookDefaultPayload(t *testing.T) {
+	s, requests := newWebhookServer(t)
+	webhooks, err := LoadWebhooks(writeWebhookConfig(t, `[{"url": "`+s.URL+`", "contentType": "application/x-ndjson"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SendToWebhooks(webhooks, []Record{{"a": 1}, {"b": "x"}}, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()
+	if len(got) != 2 || got[0].Body != `{"a":1}` || got[1].Body != `{"b":"x"}` {
+		t.Fatalf("requests %v", got)
+	}
+	if ct := got[0].Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("content type %q", ct)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	s, requests := newWebhookServer(t)
+	t.Setenv("WebhookSecret", "s3cret")
+	webhooks, err := LoadWebhooks(writeWebhookConfig(t, `[{"url": "`+s.URL+`", "secretEnv": "WebhookSecret"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SendToWebhooks(webhooks, []Record{{"a": 1}}, "MdeTimeline"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("posted %d requests, want 1", len(got))
+	}
+	timestamp := got[0].Header.Get("X-DefenderHarvester-Timestamp")
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + got[0].Body))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if timestamp == "" || got[0].Header.Get("X-DefenderHarvester-Signature") != want {
+		t.Errorf("signature %q with timestamp %q, want %q", got[0].Header.Get("X-DefenderHarvester-Signature"), timestamp, want)
+	}
+
+	// Known answer, so receivers can check their implementation against it.
+	sig := signWebhook([]byte("key"), "1700000000", []byte(`{"a":1}`))
+	if sig != "a438e398bfafc57e4396bb7fc2304422f0f768e965d073ca313cb52e22e6ad03" {
+		t.Errorf("signWebhook returned %s", sig)
+	}
+}
+
+func TestLoadWebhooksErrors(t *testing.T) {
+	t.Setenv("EmptySecret", "")
+	tests := map[string]string{
+		"empty secret":   `[{"url": "http://localhost", "secretEnv": "EmptySecret"}]`,
+		"invalid filter": `[{"url": "http://localhost", "filter": "{{ eq .type "}]`,
+		"missing file":   `[{"url": "http://localhost", "templateFile": "/nonexistent/payload.tmpl"}]`,
+		"invalid json":   `{"url": "http://localhost"}`,
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadWebhooks(writeWebhookConfig(t, config)); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+	if _, err := LoadWebhooks(""); err == nil || !strings.Contains(err.Error(), "WebhookConfig") {
+		t.Errorf("unset WebhookConfig returned %v", err)
+	}
+}
+
+func TestWebhookHost(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://hooks.slack.com/services/T0/B0/secret": "https://hooks.slack.com",
+		"https://example.com":                           "https://example.com",
+	} {
+		if got := webhookHost(url); got != want {
+			t.Errorf("webhookHost(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
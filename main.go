@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/olafhartong/defenderharvester/cmd"
 	"log"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -14,45 +16,117 @@ import (
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 )
 
+const version = "0.9.9"
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "query":
+			runQuery(os.Args[2:])
+			return
+		case "schema":
+			runSchema(os.Args[2:])
+			return
+		case "provision":
+			runProvision(os.Args[2:])
+			return
+		}
+	}
+
 	var lookback int
 	var location string
 	var sentinel bool
 	var splunk bool
 	var files bool
+	var outDir string
+	var fileName string
+	var rotateSize int64
+	var compression string
+	var fileFormat string
+	var columns string
+	var flatten bool
+	var elastic bool
+	var kafka bool
+	var eventHubs bool
+	var objectStore bool
+	var syslog bool
+	var webhooks bool
+	var otlp bool
+	var sqlite string
 	var schema bool
 	var timeline bool
+	var huntDir string
 	var machineID string
+	var latest bool
+	var devices bool
 	var machineActions bool
+	var liveResponse bool
+	var liveResponseLibrary bool
+	var indicators bool
 	var customDetections bool
 	var featureSettings bool
 	var suppressionRules bool
 	var machineGroups bool
+	var roles bool
 	var connectedApps bool
 	var executedQueries bool
 	var alertServiceSettings bool
 	var dataExportSettings bool
+	var incidents bool
+	var alerts bool
+	var graphToken string
 	var debug bool
+	var stateDir string
+	var noDedupe bool
+	var rulesFile string
 	var accessToken string
 	var token string
 	flag.IntVar(&lookback, "lookback", 1, "set the number of hours to query from the applicable sources")
 	flag.StringVar(&location, "location", "weu", "set the Azure region to query, default is weu. Get yours via the dev tools in your browser, see the blog or in the README.")
 	flag.BoolVar(&sentinel, "sentinel", false, "enable sending to Sentinel")
 	flag.BoolVar(&splunk, "splunk", false, "enable sending to Splunk")
+	flag.BoolVar(&elastic, "elastic", false, "enable sending to Elasticsearch/OpenSearch")
+	flag.BoolVar(&kafka, "kafka", false, "enable sending to Kafka")
+	flag.BoolVar(&eventHubs, "eventhubs", false, "enable sending to Azure Event Hubs")
+	flag.BoolVar(&objectStore, "objectstore", false, "enable archiving to S3 compatible or Azure Blob object storage")
+	flag.BoolVar(&syslog, "syslog", false, "enable sending to syslog as JSON, CEF or LEEF")
+	flag.BoolVar(&webhooks, "webhooks", false, "enable posting records to the webhooks in the WebhookConfig file")
+	flag.BoolVar(&otlp, "otlp", false, "enable exporting to an OpenTelemetry Collector over OTLP/HTTP or OTLP/gRPC")
+	flag.StringVar(&sqlite, "sqlite", "", "store records in the SQLite database at this path, query it with the query subcommand")
 	flag.BoolVar(&files, "files", false, "enable writing to files")
+	flag.StringVar(&outDir, "outdir", ".", "set the directory -files writes to")
+	flag.StringVar(&fileName, "filename", cmd.DefaultFileName, "set the -files name template, {table}, {date}, {day} and {hour} are replaced")
+	flag.Int64Var(&rotateSize, "rotatesize", 100, "set the size in MB at which -files starts a new file, 0 disables rotation")
+	flag.StringVar(&compression, "compress", "none", "set the -files compression: none, gzip or zstd")
+	flag.StringVar(&fileFormat, "format", "ndjson", "set the -files format: ndjson, csv or parquet")
+	flag.StringVar(&columns, "columns", "", "set a comma separated list of columns to write to CSV and Parquet files")
+	flag.BoolVar(&flatten, "flatten", false, "write nested fields as dotted CSV and Parquet columns instead of JSON strings")
 	flag.BoolVar(&schema, "schema", false, "write the MDE schema reference to a file - will never write to Sentinel")
+	flag.StringVar(&huntDir, "hunt", "", "run the advanced hunting queries in the .kql files of this directory")
 	flag.BoolVar(&timeline, "timeline", false, "gather the Timeline for a MachineId (requires -machineid and -lookback)")
-	flag.StringVar(&machineID, "machineid", "", "set the MachineId to query the timeline for")
+	flag.StringVar(&machineID, "machineid", "", "set the MachineId, DNS name, NetBIOS name or IP address to query the timeline for")
+	flag.BoolVar(&latest, "latest", false, "pick the most recently seen device when -machineid matches several")
+	flag.BoolVar(&devices, "devices", false, "enable querying the device inventory")
 	flag.BoolVar(&machineActions, "machineactions", false, "enable querying the MachineActions / LiveResponse actions")
+	flag.BoolVar(&liveResponse, "liveresponse", false, "enable querying the commands run in Live Response sessions")
+	flag.BoolVar(&liveResponseLibrary, "liveresponselibrary", false, "enable querying the files in the Live Response library")
+	flag.BoolVar(&indicators, "indicators", false, "enable querying the custom file, IP, URL and certificate indicators")
 	flag.BoolVar(&customDetections, "customdetections", false, "enable querying the Custom Detection state")
 	flag.BoolVar(&featureSettings, "featuresettings", false, "enable querying the Advanced Feature Settings")
 	flag.BoolVar(&suppressionRules, "suppressionrules", false, "enable querying the Suppression rule Settings")
 	flag.BoolVar(&machineGroups, "machinegroups", false, "enable querying the Machine Groups")
+	flag.BoolVar(&roles, "roles", false, "enable querying the RBAC roles and the machine groups they apply to")
 	flag.BoolVar(&connectedApps, "connectedapps", false, "enable querying the Connected App Statistics")
 	flag.BoolVar(&executedQueries, "executedqueries", false, "enable querying the Executed Queries")
 	flag.BoolVar(&alertServiceSettings, "alertservicesettings", false, "enable querying the M365 XDR Alert Service Settings")
 	flag.BoolVar(&dataExportSettings, "dataexportsettings", false, "enable querying the M365 XDR Data Export Settings")
+	flag.BoolVar(&incidents, "incidents", false, "enable querying the M365 XDR incidents with their alerts through Microsoft Graph")
+	flag.BoolVar(&alerts, "alerts", false, "enable querying the M365 XDR alerts with their evidence through Microsoft Graph")
 	flag.StringVar(&accessToken, "accesstoken", "", "bring your own access token")
+	flag.StringVar(&graphToken, "graphtoken", "", "bring your own Microsoft Graph access token for -incidents and -alerts")
+	flag.StringVar(&stateDir, "statedir", cmd.DefaultStateDir(), "set the directory where state is kept between runs")
+	flag.BoolVar(&noDedupe, "nodedupe", false, "disable skipping records already delivered by a previous run")
+	flag.StringVar(&rulesFile, "rules", "", "set a JSON file with detection rules extending the shipped configuration change rules")
 	flag.BoolVar(&debug, "debug", false, "Provide debugging output")
 	flag.Parse()
 
@@ -64,7 +138,7 @@ func main() {
 	fmt.Println("  '?@@@@@@#%%%%%%%%%%#@@@@@@?'")
 	fmt.Println("   ?+';@@@@^^@@@@@@^^@@@+'+?")
 	fmt.Println("      ;@@@'  '@@@@'  '@@@+")
-	fmt.Println("       ;#@@@-@@@@@@-@@@%;	DefenderHarvester v0.9.9 - by Olaf Hartong")
+	fmt.Println("       ;#@@@-@@@@@@-@@@%;	DefenderHarvester v" + version + " - by Olaf Hartong")
 	fmt.Println("        .?@@@@----@@@@?.	 ↳ Collects interesting events from MDE/M365D, of which")
 	fmt.Println("          '+?%@@@@%?+'		   most are sadly only available on the ServiceAPI :|")
 	fmt.Println("              .;;.")
@@ -75,26 +149,99 @@ func main() {
 		token = accessToken
 	} else {
 		log.Println("Getting access token ...")
-		accessToken, err := getToken()
+		accessToken, err := getToken(mdeResource)
 		if err != nil {
 			log.Fatalln(err)
 		}
 		token = accessToken
 	}
 
+	if (incidents || alerts) && graphToken == "" {
+		log.Println("Getting Microsoft Graph access token ...")
+		accessToken, err := getToken(cmd.GraphResource)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		graphToken = accessToken
+	}
+
+	state, err := cmd.NewStateStore(stateDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	rules, err := cmd.LoadRules(rulesFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var webhookConfig []cmd.Webhook
+	if webhooks {
+		if webhookConfig, err = cmd.LoadWebhooks(os.Getenv("WebhookConfig")); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	cfg := cmd.Config{
+		AccessToken:      token,
+		GraphToken:       graphToken,
+		TenantID:         cmd.TenantFromToken(token),
+		Region:           location,
+		HarvesterVersion: version,
+		HarvestTime:      time.Now().UTC(),
+		State:            state,
+		Dedupe:           !noDedupe,
+		Rules:            rules,
+		Sentinel:         sentinel,
+		Splunk:           splunk,
+		Files:            files,
+		FileOptions: cmd.FileOptions{
+			Dir:         outDir,
+			Name:        fileName,
+			RotateBytes: rotateSize * 1024 * 1024,
+			Compression: compression,
+			Format:      fileFormat,
+			Columns:     splitList(columns),
+			Flatten:     flatten,
+		},
+		Elastic:     elastic,
+		Kafka:       kafka,
+		EventHubs:   eventHubs,
+		ObjectStore: objectStore,
+		Syslog:      syslog,
+		Webhooks:    webhookConfig,
+		OTLP:        otlp,
+		SQLite:      sqlite,
+		Debug:       debug,
+	}
+
 	if schema {
 		log.Println("Retrieving MDE schema reference ...")
 		schemaEndpoint := "/api/ine/huntingservice/schema"
 		APIlocation := "m365d-hunting-api-prd-" + location
-		schemaQueryParams := ""
+		// The schema reference only goes to files, so start without sinks.
+		schemaCfg := cmd.Config{
+			AccessToken:      cfg.AccessToken,
+			TenantID:         cfg.TenantID,
+			Region:           cfg.Region,
+			HarvesterVersion: cfg.HarvesterVersion,
+			HarvestTime:      cfg.HarvestTime,
+			State:            cfg.State,
+			Dedupe:           cfg.Dedupe,
+			Rules:            cfg.Rules,
+			Files:            true,
+			FileOptions:      cfg.FileOptions,
+			Debug:            cfg.Debug,
+		}
 		hostname := getM365XDRDomainName(APIlocation, schemaEndpoint)
-		if err := cmd.GetDataFromMDE(token, schemaEndpoint, schemaQueryParams, false, "MdeSchemaReference", true, false, debug, hostname); err != nil {
+		if err := cmd.GetSchemaReference(schemaCfg, schemaEndpoint, "MdeSchemaReference", hostname); err != nil {
 			log.Fatalln(err)
 		}
 		return
 	}
 
-	from := time.Now().UTC().Add(-time.Duration(lookback) * time.Hour).Format(time.RFC3339Nano)
+	fromTime := time.Now().UTC().Add(-time.Duration(lookback) * time.Hour)
+	from := fromTime.Format(time.RFC3339Nano)
 	fromURL := url.QueryEscape(from)
 
 	now := time.Now().UTC().Format("2006-01-02T15:04:05.999Z")
@@ -104,25 +251,53 @@ func main() {
 	log.Printf("Querying From: %s to: %s\n", from, now)
 
 	if timeline {
+		machineID, err := cmd.ResolveMachineID(cfg, getM365XDRDomainName("wdatpprd-"+location, "/api/machines"), machineID, latest)
+		if err != nil {
+			log.Fatalln(err)
+		}
 		log.Printf("Retrieving Timeline events for %s ...", machineID)
 		log.Printf("Depending on the lookback, this can take a while, get some %s", "☕")
 		TLEndpoint := fmt.Sprintf("/api/detection/experience/timeline/machines/%s/events/?machineId=%s&doNotUseCache=false&forceUseCache=false&fromDate=%s&pageSize=1000", machineID, machineID, fromURL)
 		TLQueryParams := ""
+		timelineCfg := cfg
+		timelineCfg.Files = true
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, TLEndpoint)
-		if _, err := cmd.GetTimelineData(token, TLEndpoint, TLQueryParams, sentinel, "MdeTimeline", true, from, splunk, debug, hostname); err != nil {
+		if _, err := cmd.GetTimelineData(timelineCfg, TLEndpoint, TLQueryParams, "MdeTimeline", from, hostname); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if huntDir != "" {
+		log.Printf("Running hunting queries from %s ...", huntDir)
+		huntEndpoint := "/api/advancedqueries/run"
+		APIlocation := "wdatpprd-" + location
+		hostname := getM365XDRDomainName(APIlocation, huntEndpoint)
+		if err := cmd.RunHunts(cfg, huntEndpoint, hostname, huntDir, time.Duration(lookback)*time.Hour); err != nil {
 			log.Fatalln(err)
 		}
 		return
 	}
 
+	if devices {
+		log.Println("Retrieving Device Inventory ...")
+		devicesEndpoint := "/api/machines"
+		devicesQueryParams := ""
+		APIlocation := "wdatpprd-" + location
+		hostname := getM365XDRDomainName(APIlocation, devicesEndpoint)
+		if err := cmd.GetDataFromMDEAPI(cfg, devicesEndpoint, devicesQueryParams, cmd.DevicesTable, hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	if machineActions {
 		log.Println("Retrieving Action Center History ...")
 		ACendpoint := "/api/autoir/actioncenterui/history-actions"
 		ACqueryParams := fmt.Sprintf("/?useMtpApi=true&pageIndex=1&fromDate=%s&toDate=%s&sortByField=eventTime&sortOrder=Descending", fromURL, nowURL)
 		APIlocation := "m365d-autoir-ac-prd-" + location
 		hostname := getM365XDRDomainName(APIlocation, ACendpoint)
-		if err := cmd.GetDataFromMDE(token, ACendpoint, ACqueryParams, sentinel, "MdeMachineActions", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDE(cfg, ACendpoint, ACqueryParams, "MdeMachineActions", hostname); err != nil {
 			log.Fatalln(err)
 		}
 
@@ -133,7 +308,41 @@ func main() {
 		MAQueryParams := strings.ReplaceAll(escapedQuery, "+", "%20")
 		APIlocation = "wdatpprd-" + location
 		hostname = getM365XDRDomainName(APIlocation, MAEndpoint)
-		if err := cmd.GetDataFromMDEAPI(token, MAEndpoint, MAQueryParams, sentinel, "MdeMachineActionsApi", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDEAPI(cfg, MAEndpoint, MAQueryParams, "MdeMachineActionsApi", hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if liveResponse {
+		log.Println("Retrieving Live Response commands ...")
+		LRendpoint := "/api/machineactions"
+		LRquery := fmt.Sprintf("type eq 'LiveResponse' and lastUpdateDateTimeUtc ge %s", from)
+		LRqueryParams := "?$filter=" + strings.ReplaceAll(url.QueryEscape(LRquery), "+", "%20")
+		APIlocation := "wdatpprd-" + location
+		hostname := getM365XDRDomainName(APIlocation, LRendpoint)
+		if err := cmd.GetLiveResponseCommands(cfg, LRendpoint, LRqueryParams, cmd.LiveResponseTable, hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if liveResponseLibrary {
+		log.Println("Retrieving Live Response library ...")
+		LLendpoint := "/api/libraryfiles"
+		LLqueryParams := ""
+		APIlocation := "wdatpprd-" + location
+		hostname := getM365XDRDomainName(APIlocation, LLendpoint)
+		if err := cmd.GetDataFromMDEAPI(cfg, LLendpoint, LLqueryParams, "MdeLiveResponseLibrary", hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if indicators {
+		log.Println("Retrieving Indicators ...")
+		IOCendpoint := "/api/indicators"
+		IOCqueryParams := ""
+		APIlocation := "wdatpprd-" + location
+		hostname := getM365XDRDomainName(APIlocation, IOCendpoint)
+		if err := cmd.GetDataFromMDEAPI(cfg, IOCendpoint, IOCqueryParams, "MdeIndicators", hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -144,7 +353,7 @@ func main() {
 		CDqueryParams := "?pageIndex=1&pageSize=1000&sortOrder=Descending"
 		APIlocation := "m365d-hunting-api-prd-" + location
 		hostname := getM365XDRDomainName(APIlocation, CDendpoint)
-		if err := cmd.GetDataFromMDE(token, CDendpoint, CDqueryParams, sentinel, "MdeCustomDetectionState", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDE(cfg, CDendpoint, CDqueryParams, "MdeCustomDetectionState", hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -155,18 +364,18 @@ func main() {
 		tenantQueryParams := ""
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, tenantEndpoint)
-		if err := cmd.GetDataFromMDE(token, tenantEndpoint, tenantQueryParams, sentinel, "MdeAdvancedFeatureSettings", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDE(cfg, tenantEndpoint, tenantQueryParams, "MdeAdvancedFeatureSettings", hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
 
 	if suppressionRules {
-		log.Println("Retrieving Advanced Feature Settings ...")
+		log.Println("Retrieving Suppression Rules ...")
 		tenantEndpoint := "/api/ine/suppressionrulesservice/suppressionRules"
 		tenantQueryParams := ""
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, tenantEndpoint)
-		if err := cmd.GetDataFromMDE(token, tenantEndpoint, tenantQueryParams, sentinel, "MdeAdvancedFeatureSettings", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDE(cfg, tenantEndpoint, tenantQueryParams, "MdeSuppressionRules", hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -177,7 +386,18 @@ func main() {
 		settingsQueryParams := ""
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, settingsEndpoint)
-		if err := cmd.GetDataFromMDE(token, settingsEndpoint, settingsQueryParams, sentinel, "MdeMachineGroups", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDE(cfg, settingsEndpoint, settingsQueryParams, "MdeMachineGroups", hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if roles {
+		log.Println("Retrieving RBAC Roles ...")
+		rolesEndpoint := "/rbac/user_roles"
+		machineGroupsEndpoint := "/rbac/machine_groups"
+		APIlocation := "wdatpprd-" + location
+		hostname := getM365XDRDomainName(APIlocation, rolesEndpoint)
+		if err := cmd.GetRBACRoles(cfg, rolesEndpoint, machineGroupsEndpoint, hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -188,7 +408,7 @@ func main() {
 		conAppsQueryParams := ""
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, conAppsEndpoint)
-		if err := cmd.GetDataFromMDE(token, conAppsEndpoint, conAppsQueryParams, sentinel, "MdeConnectedAppStats", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDE(cfg, conAppsEndpoint, conAppsQueryParams, "MdeConnectedAppStats", hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -200,7 +420,25 @@ func main() {
 		ranQueriesQueryParams := []byte(query)
 		APIlocation := "m365d-hunting-api-prd-" + location
 		hostname := getM365XDRDomainName(APIlocation, ranQueriesEndpoint)
-		if err := cmd.PostDataToMDE(token, ranQueriesEndpoint, ranQueriesQueryParams, sentinel, "MdeExecutedQueries", files, splunk, debug, hostname); err != nil {
+		if err := cmd.PostDataToMDE(cfg, ranQueriesEndpoint, ranQueriesQueryParams, "MdeExecutedQueries", hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if incidents {
+		log.Println("Retrieving Incidents ...")
+		incidentsEndpoint := "/v1.0/security/incidents"
+		incidentsQueryParams := "$expand=alerts&$top=50"
+		if err := cmd.GetGraphSecurityData(cfg, incidentsEndpoint, incidentsQueryParams, "M365Incidents", fromTime); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if alerts {
+		log.Println("Retrieving Alerts ...")
+		alertsEndpoint := "/v1.0/security/alerts_v2"
+		alertsQueryParams := ""
+		if err := cmd.GetGraphSecurityData(cfg, alertsEndpoint, alertsQueryParams, "M365Alerts", fromTime); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -212,7 +450,7 @@ func main() {
 		alertServiceSettingsQueryParams := "?includeDetails=true"
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, alertServiceSettingsEndpoint)
-		if err := cmd.GetDataFromMDEAPI(token, alertServiceSettingsEndpoint, alertServiceSettingsQueryParams, sentinel, "M365AlertServiceSettings", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDEAPI(cfg, alertServiceSettingsEndpoint, alertServiceSettingsQueryParams, "M365AlertServiceSettings", hostname); err != nil {
 			log.Fatalln(err)
 		}
 	}
@@ -224,14 +462,214 @@ func main() {
 		dataExportSettingsQueryParams := ""
 		APIlocation := "wdatpprd-" + location
 		hostname := getM365XDRDomainName(APIlocation, dataExportSettingsEndpoint)
-		if err := cmd.GetDataFromMDEAPI(token, dataExportSettingsEndpoint, dataExportSettingsQueryParams, sentinel, "M365DataExportSettings", files, splunk, debug, hostname); err != nil {
+		if err := cmd.GetDataFromMDEAPI(cfg, dataExportSettingsEndpoint, dataExportSettingsQueryParams, "M365DataExportSettings", hostname); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// runQuery implements the query subcommand, which runs SQL against the
+// database written by -sqlite.
+func runQuery(args []string) {
+	var db string
+	var output string
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	flags.StringVar(&db, "db", "defenderharvester.db", "set the SQLite database to query")
+	flags.StringVar(&output, "output", "table", "set the output format: table or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: defenderharvester query [-db file] [-output table|json] \"SELECT ...\"")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, err := os.Stat(db); err != nil {
+		log.Fatalln(err)
+	}
+	if err := cmd.QuerySQLite(db, flags.Arg(0), output, os.Stdout); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// runSchema implements the schema subcommand, which lists, compares and
+// renders the schema versions stored by -schema.
+func runSchema(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: defenderharvester schema versions|diff|render [options]")
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	var stateDir string
+	var from int
+	var to int
+	var version int
+	var format string
+	flags := flag.NewFlagSet("schema "+args[0], flag.ExitOnError)
+	flags.StringVar(&stateDir, "statedir", cmd.DefaultStateDir(), "set the directory where state is kept between runs")
+	switch args[0] {
+	case "versions":
+	case "diff":
+		flags.IntVar(&from, "from", -1, "set the version to compare from, counting back from the latest when zero or negative")
+		flags.IntVar(&to, "to", 0, "set the version to compare to, counting back from the latest when zero or negative")
+		flags.StringVar(&format, "format", "text", "set the output format: text or json")
+	case "render":
+		flags.IntVar(&version, "version", 0, "set the version to render, counting back from the latest when zero or negative")
+		flags.StringVar(&format, "format", "markdown", "set the output format: markdown or kql")
+	default:
+		usage()
+	}
+	flags.Parse(args[1:])
+
+	state, err := cmd.NewStateStore(stateDir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	switch args[0] {
+	case "versions":
+		versions, err := cmd.SchemaVersions(state)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, v := range versions {
+			fmt.Printf("%d\t%s\t%s\n", v.Version, v.Time.Format(time.RFC3339), v.Hash[:12])
+		}
+
+	case "diff":
+		versions, err := cmd.SchemaVersions(state)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		// With a single version the relative defaults point before the first.
+		if len(versions) < 2 && from <= 0 && to <= 0 {
+			if format == "json" {
+				fmt.Println("[]")
+				return
+			}
+			if len(versions) == 0 {
+				fmt.Println("No schema versions stored yet, run with -schema first")
+			} else {
+				fmt.Printf("Only schema version %d is stored, nothing to compare it with\n", versions[0].Version)
+			}
+			return
+		}
+		old, err := cmd.LoadSchemaSnapshot(state, from)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		current, err := cmd.LoadSchemaSnapshot(state, to)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		changes := cmd.DiffSchemas(old.Tables, current.Tables)
+		switch format {
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(changes); err != nil {
+				log.Fatalln(err)
+			}
+		case "text":
+			fmt.Printf("Schema version %d (%s) to %d (%s): %d changes\n", old.Version, old.Time.Format(time.RFC3339), current.Version, current.Time.Format(time.RFC3339), len(changes))
+			for _, change := range changes {
+				line := change.Change + " " + change.Table
+				if change.Column != "" {
+					line += "." + change.Column
+				}
+				switch {
+				case change.OldType != "" && change.NewType != "":
+					line += fmt.Sprintf(" (%s -> %s)", change.OldType, change.NewType)
+				case change.NewType != "":
+					line += " (" + change.NewType + ")"
+				case change.OldType != "":
+					line += " (" + change.OldType + ")"
+				}
+				fmt.Println(line)
+			}
+		default:
+			log.Fatalf("unsupported format %q, use text or json\n", format)
+		}
+
+	case "render":
+		snapshot, err := cmd.LoadSchemaSnapshot(state, version)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		switch format {
+		case "markdown":
+			cmd.RenderSchemaMarkdown(os.Stdout, snapshot.Tables)
+		case "kql":
+			cmd.RenderSchemaKQL(os.Stdout, snapshot.Tables)
+		default:
+			log.Fatalf("unsupported format %q, use markdown or kql\n", format)
+		}
+	}
+}
+
+// runProvision implements the provision subcommand, which writes the Sentinel
+// custom tables and data collection rules for the collectors.
+func runProvision(args []string) {
+	var sampleDir string
+	var tables string
+	var format string
+	flags := flag.NewFlagSet("provision", flag.ExitOnError)
+	flags.StringVar(&sampleDir, "sample", "", "set the directory with NDJSON files written by -files to sample the columns from")
+	flags.StringVar(&tables, "tables", "", "set the comma separated tables to provision, all declared and sampled tables by default")
+	flags.StringVar(&format, "format", "arm", "set the output format: arm, bicep or json")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: defenderharvester provision [-sample dir] [-tables list] [-format arm|bicep|json]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var samples map[string][]cmd.Record
+	if sampleDir != "" {
+		var err error
+		if samples, err = cmd.LoadSamples(sampleDir); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	provisioned := cmd.ProvisionTables(splitList(tables), samples)
+	if len(provisioned) == 0 {
+		log.Fatalln("No tables to provision, use -sample to sample the columns of collected tables")
+	}
+
+	switch format {
+	case "arm":
+		if err := cmd.RenderARM(os.Stdout, provisioned); err != nil {
 			log.Fatalln(err)
 		}
+	case "bicep":
+		cmd.RenderBicep(os.Stdout, provisioned)
+	case "json":
+		if err := cmd.RenderProvisionJSON(os.Stdout, provisioned); err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		log.Fatalf("unsupported format %q, use arm, bicep or json\n", format)
+	}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
 
-func getToken() (string, error) {
-	resource := "https://securitycenter.microsoft.com/mtp"
+// mdeResource is the service API the default access token is requested for.
+const mdeResource = "https://securitycenter.microsoft.com/mtp"
+
+func getToken(resource string) (string, error) {
 	tokenCredential, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create credential: %w", err)
@@ -245,9 +683,21 @@ func getToken() (string, error) {
 	return token.Token, nil
 }
 
+// publicAPIEndpoints are served by the regional public API hosts.
+var publicAPIEndpoints = []string{"/api/dataexportsettings", "/api/machineactions", "/api/libraryfiles", "/api/indicators", "/api/machines", "/api/advancedqueries"}
+
+func isPublicAPI(url string) bool {
+	for _, endpoint := range publicAPIEndpoints {
+		if strings.HasPrefix(url, endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
 func getM365XDRDomainName(location string, url string) string {
 	if strings.Contains(location, "wdatpprd-weu3") {
-		if url == "/api/dataexportsettings" || strings.Contains(url, "/api/machineactions") {
+		if isPublicAPI(url) {
 			return "api-eu"
 		} else if url == "/api/ine/alertsapiservice/workloads/disabled" {
 			return "m365duseprd-weu3"
@@ -257,7 +707,7 @@ func getM365XDRDomainName(location string, url string) string {
 			return location
 		}
 	} else if strings.Contains(location, "wdatpprd-weu") {
-		if url == "/api/dataexportsettings" || strings.Contains(url, "/api/machineactions") {
+		if isPublicAPI(url) {
 			return "api-eu"
 		} else if url == "/api/ine/alertsapiservice/workloads/disabled" {
 			return "m365duseprd-weu"
@@ -267,7 +717,7 @@ func getM365XDRDomainName(location string, url string) string {
 			return location
 		}
 	} else if strings.Contains(location, "wdatpprd-eus3") {
-		if url == "/api/dataexportsettings" || strings.Contains(url, "/api/machineactions") {
+		if isPublicAPI(url) {
 			return "api-us"
 		} else if url == "/api/ine/alertsapiservice/workloads/disabled" {
 			return "m365duseprd-eus3"
@@ -277,7 +727,7 @@ func getM365XDRDomainName(location string, url string) string {
 			return location
 		}
 	} else if strings.Contains(location, "wdatpprd-eus") {
-		if url == "/api/dataexportsettings" || strings.Contains(url, "/api/machineactions") {
+		if isPublicAPI(url) {
 			return "api-us"
 		} else if url == "/api/ine/alertsapiservice/workloads/disabled" {
 			return "m365duseprd-eus"